@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Template di default per il formato testo dell'access log
+const defaultAccessTemplate = `{{.Time.Format "2006-01-02T15:04:05.000Z07:00"}} conn={{.ConnID}} client={{.Client}} method={{.Method}} dest={{.Dest}} remote={{.RemoteIP}} backend={{.Backend}} dial_ms={{ms .DialTime}} duration_ms={{ms .Duration}} up={{.BytesUp}} down={{.BytesDown}} close={{.CloseReason}}{{with .Phase}} phase={{.}}{{end}}{{with .Rep}} rep={{.}}{{end}}`
+
+// AccessRecord è una riga dell'access log, scritta alla chiusura di ogni connessione
+type AccessRecord struct {
+	Time        time.Time     `json:"time"` // inizio della connessione
+	ConnID      uint64        `json:"conn"`
+	Client      string        `json:"client"`
+	Method      string        `json:"method"` // CONNECT (SOCKS5) o TUNNEL
+	Dest        string        `json:"dest"`
+	RemoteIP    string        `json:"remote_ip,omitempty"`
+	Backend     string        `json:"backend"`
+	DialTime    time.Duration `json:"-"`
+	Duration    time.Duration `json:"-"`
+	BytesUp     uint64        `json:"bytes_up"`
+	BytesDown   uint64        `json:"bytes_down"`
+	CloseReason string        `json:"close_reason"`
+	Phase       string        `json:"phase,omitempty"` // handshake SOCKS rifiutato: greeting, request o reply
+	Rep         string        `json:"rep,omitempty"`   // codice REP SOCKS5 inviato al client, es. 0x07
+}
+
+// MarshalJSON esporta le durate in millisecondi
+func (r AccessRecord) MarshalJSON() ([]byte, error) {
+	type plain AccessRecord
+	return json.Marshal(struct {
+		plain
+		DialMs     float64 `json:"dial_ms"`
+		DurationMs float64 `json:"duration_ms"`
+	}{plain(r), durationMs(r.DialTime), durationMs(r.Duration)})
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// AccessLogger scrive una riga per connessione terminata, in JSON o con un text/template
+type AccessLogger struct {
+	mu   sync.Mutex
+	w    io.WriteCloser
+	tmpl *template.Template // nil = JSON
+	buf  bytes.Buffer
+}
+
+// NewAccessLogger accetta come format "json", "text" (template di default)
+// oppure direttamente un text/template sui campi di AccessRecord
+func NewAccessLogger(w io.WriteCloser, format string) (*AccessLogger, error) {
+	a := &AccessLogger{w: w}
+	if format == "json" {
+		return a, nil
+	}
+	if format == "" || format == "text" {
+		format = defaultAccessTemplate
+	}
+	tmpl, err := template.New("access").Funcs(template.FuncMap{
+		"ms": func(d time.Duration) string { return fmt.Sprintf("%.1f", durationMs(d)) },
+	}).Parse(format)
+	if err != nil {
+		return nil, fmt.Errorf("access log template: %w", err)
+	}
+	a.tmpl = tmpl
+	return a, nil
+}
+
+// openAccessLog apre l'access log su file con rotazione, o su stdout se path è "-"
+func openAccessLog(path, format string, maxMB, keep int) (*AccessLogger, error) {
+	var w io.WriteCloser = nopWriteCloser{os.Stdout}
+	if path != "-" {
+		rf, err := NewRotatingFile(path, int64(maxMB)*1024*1024, keep)
+		if err != nil {
+			return nil, fmt.Errorf("access log: %w", err)
+		}
+		w = rf
+	}
+	al, err := NewAccessLogger(w, format)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	return al, nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func (a *AccessLogger) Log(rec AccessRecord) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.buf.Reset()
+	if a.tmpl == nil {
+		if err := json.NewEncoder(&a.buf).Encode(rec); err != nil {
+			return err
+		}
+	} else {
+		if err := a.tmpl.Execute(&a.buf, rec); err != nil {
+			return err
+		}
+		a.buf.WriteByte('\n')
+	}
+	_, err := a.w.Write(a.buf.Bytes())
+	return err
+}
+
+func (a *AccessLogger) Close() error {
+	return a.w.Close()
+}
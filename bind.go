@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// BindMode indica come le connessioni di un backend vengono legate alla sua interfaccia
+type BindMode string
+
+const (
+	BindAuto   BindMode = "auto"   // SO_BINDTODEVICE se permesso, altrimenti solo IP sorgente
+	BindDevice BindMode = "device" // SO_BINDTODEVICE: senza permessi il dial fallisce
+	BindSource BindMode = "source" // solo IP sorgente: l'uscita dipende dalle regole di routing
+	BindMark   BindMode = "mark"   // SO_MARK con il numero della tabella del policy routing
+)
+
+// ParseBindMode accetta i nomi dei modi; vuoto vale "auto"
+func ParseBindMode(s string) (BindMode, error) {
+	switch m := BindMode(s); m {
+	case "", BindAuto:
+		return BindAuto, nil
+	case BindDevice, BindSource, BindMark:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid bind mode %q (want auto, device, source or mark)", s)
+}
+
+// ParseMark accetta un fwmark decimale o esadecimale ("0x10")
+func ParseMark(s string) (uint32, error) {
+	v, err := strconv.ParseUint(strings.TrimSpace(s), 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid fwmark %q", s)
+	}
+	return uint32(v), nil
+}
+
+// parseMarks legge la lista "interfaccia=mark,..." del flag -fwmark
+func parseMarks(s string) (map[string]uint32, error) {
+	marks := make(map[string]uint32)
+	for _, kv := range strings.Split(s, ",") {
+		name, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid fwmark %q (want interface=mark)", kv)
+		}
+		mark, err := ParseMark(v)
+		if err != nil {
+			return nil, err
+		}
+		marks[name] = mark
+	}
+	return marks, nil
+}
+
+// bindDeviceCheck prova una sola volta se il processo può usare SO_BINDTODEVICE
+var bindDeviceCheck = sync.OnceValue(probeBindToDevice)
+
+// bindMode restituisce il modo effettivo del backend, risolvendo "auto" con i permessi rilevati
+func (b *Backend) bindMode() BindMode {
+	if b.Interface == "" {
+		return BindSource // backend per IP su un'interfaccia sconosciuta
+	}
+	switch b.Bind {
+	case "", BindAuto:
+		if bindDeviceCheck() == nil {
+			return BindDevice
+		}
+		return BindSource
+	}
+	return b.Bind
+}
+
+// BindWarnings descrive i limiti di permessi rilevati all'avvio, per GUI e dashboard
+func BindWarnings() []string {
+	if len(bindModeChoices) == 0 {
+		return nil // la scelta del modo esiste solo dove c'è SO_BINDTODEVICE
+	}
+	if err := bindDeviceCheck(); err != nil {
+		return []string{fmt.Sprintf("SO_BINDTODEVICE is not permitted (%v): without CAP_NET_RAW, backends in auto mode only bind the source IP, "+
+			"so their traffic may leave through the default route. Run with CAP_NET_RAW, use -policy-routing, or pick a bind mode per interface.", err)}
+	}
+	return nil
+}
+
+// markText formatta un fwmark come nei comandi ip/nft; vuoto se non impostato
+func markText(mark uint32) string {
+	if mark == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%#x", mark)
+}
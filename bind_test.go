@@ -0,0 +1,58 @@
+package main
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestParseMark(t *testing.T) {
+	tests := []struct {
+		in   string
+		want uint32
+		ok   bool
+	}{
+		{"16", 16, true},
+		{"0x10", 16, true},
+		{" 0X20 ", 32, true},
+		{"0o17", 15, true},
+		{"0", 0, true},
+		{"0xffffffff", 0xffffffff, true},
+		{"0x100000000", 0, false}, // oltre 32 bit
+		{"-1", 0, false},
+		{"", 0, false},
+		{"mark", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseMark(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseMark(%q) = %#x, %v; want %#x, ok=%v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParseMarks(t *testing.T) {
+	tests := []struct {
+		in   string
+		want map[string]uint32
+	}{
+		{"usb0=0x10", map[string]uint32{"usb0": 0x10}},
+		{"usb0=0x10, wlan0=32", map[string]uint32{"usb0": 0x10, "wlan0": 32}},
+		{"usb0=1,usb0=2", map[string]uint32{"usb0": 2}}, // vale l'ultimo
+		{"usb0", nil},
+		{"=0x10", nil},
+		{"usb0=0x10,", nil},
+		{"usb0=zz", nil},
+	}
+	for _, tt := range tests {
+		got, err := parseMarks(tt.in)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("parseMarks(%q) = %v, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || !maps.Equal(got, tt.want) {
+			t.Errorf("parseMarks(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Protocollo del bonding: il client apre verso il relay un tunnel TCP per interfaccia
+// (lane), ognuno con un hello che indica sessione e destinazione; il relay apre una sola
+// connessione verso la destinazione e risponde su ogni lane. Da lì i byte di ogni
+// direzione viaggiano in frame numerati distribuiti sulle lane (ognuna prende il frame
+// successivo appena il suo socket può scrivere, quindi le più veloci ne portano di più)
+// e il lato ricevente li rimette in ordine.
+const (
+	bondMagic       = "DPB1"
+	bondDefaultPort = "7300"
+	bondSessionLen  = 16
+	bondMACLen      = sha256.Size
+	bondFrameHdr    = 11        // tipo (1), lunghezza (2), numero di sequenza (8)
+	bondFrameMax    = 16 << 10  // payload massimo di un frame
+	bondWindow      = 256       // frame fuori ordine tenuti dal ricevente prima di fermare le lane
+	bondNotSent     = 128 << 10 // byte non ancora inviati per lane (TCP_NOTSENT_LOWAT)
+	bondMaxSkew     = 2 * time.Minute
+	bondLaneGrace   = time.Second     // attesa delle altre lane dopo la prima pronta
+	bondCloseWait   = 5 * time.Second // tempo per svuotare le code alla chiusura ordinata
+)
+
+// Tipi di frame
+const (
+	bondFrameData  = 0
+	bondFrameFin   = 1 // fine dei dati in questa direzione (half-close)
+	bondFrameReady = 2 // il client usa la lane: primo frame, senza numero di sequenza
+)
+
+// errBondAuth è un hello con chiave sbagliata o ora fuori tolleranza
+var errBondAuth = errors.New("bond: authentication failed")
+
+// bondHello è il messaggio di apertura di una lane:
+// magic, sessione, lane, ora (Unix), destinazione (lunghezza + testo), HMAC-SHA256 con la chiave
+// su tutti i campi, così un hello intercettato non si può riusare per un'altra lane
+type bondHello struct {
+	Session [bondSessionLen]byte
+	Lane    uint8
+	Time    int64
+	Target  string
+}
+
+func (h *bondHello) mac(key []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(bondMagic))
+	m.Write(h.Session[:])
+	m.Write([]byte{h.Lane})
+	binary.Write(m, binary.BigEndian, h.Time)
+	m.Write([]byte(h.Target))
+	return m.Sum(nil)
+}
+
+func (h *bondHello) encode(key []byte) []byte {
+	b := append([]byte(bondMagic), h.Session[:]...)
+	b = append(b, h.Lane)
+	b = binary.BigEndian.AppendUint64(b, uint64(h.Time))
+	b = append(b, byte(len(h.Target)))
+	b = append(b, h.Target...)
+	return append(b, h.mac(key)...)
+}
+
+// readBondHello legge un hello e ne verifica chiave e ora
+func readBondHello(r io.Reader, key []byte) (*bondHello, error) {
+	var hdr [len(bondMagic) + bondSessionLen + 1 + 8 + 1]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if string(hdr[:len(bondMagic)]) != bondMagic {
+		return nil, errors.New("not a bond client")
+	}
+	h := &bondHello{}
+	p := hdr[len(bondMagic):]
+	copy(h.Session[:], p)
+	p = p[bondSessionLen:]
+	h.Lane = p[0]
+	h.Time = int64(binary.BigEndian.Uint64(p[1:]))
+	rest := make([]byte, int(p[9])+bondMACLen)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, err
+	}
+	h.Target = string(rest[:p[9]])
+	if !hmac.Equal(rest[p[9]:], h.mac(key)) {
+		return nil, fmt.Errorf("%w: wrong key", errBondAuth)
+	}
+	if skew := time.Since(time.Unix(h.Time, 0)); skew > bondMaxSkew || skew < -bondMaxSkew {
+		return nil, fmt.Errorf("%w: clock skew %s", errBondAuth, skew.Round(time.Second))
+	}
+	if _, _, err := net.SplitHostPort(h.Target); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// bondReply è la risposta del relay a un hello: codice SOCKS5 e indirizzo della destinazione
+func bondReply(rep byte, remote net.Addr) []byte {
+	addr := ""
+	if remote != nil {
+		addr = remote.String()
+	}
+	return append([]byte{rep, byte(len(addr))}, addr...)
+}
+
+func readBondReply(r io.Reader) (byte, string, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, "", err
+	}
+	addr := make([]byte, hdr[1])
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return 0, "", err
+	}
+	return hdr[0], string(addr), nil
+}
+
+func bondFrame(typ byte, seq uint64, payload []byte) []byte {
+	b := make([]byte, bondFrameHdr, bondFrameHdr+len(payload))
+	b[0] = typ
+	binary.BigEndian.PutUint16(b[1:], uint16(len(payload)))
+	binary.BigEndian.PutUint64(b[3:], seq)
+	return append(b, payload...)
+}
+
+// bondKey è la chiave condivisa con il relay: la password dell'URL bond://:chiave@host
+func bondKey(b *Backend) []byte {
+	if b.Upstream.User == nil {
+		return nil
+	}
+	key, _ := b.Upstream.User.Password()
+	return []byte(key)
+}
+
+// dialBond apre la connessione verso remoteAddr attraverso il relay del backend bond,
+// con un tunnel per ogni interfaccia restituita da bondLanes. Le lane che non sono pronte
+// entro bondLaneGrace dalla prima vengono lasciate perdere; se nessuna è pronta restituisce
+// l'errore del relay (o del primo dial).
+func dialBond(ctx context.Context, lb *Backend, remoteAddr string) (net.Conn, error) {
+	if len(remoteAddr) > 255 {
+		return nil, errors.New("host name too long")
+	}
+	var lanes []*Backend
+	if lb.bondLanes != nil {
+		lanes = lb.bondLanes()
+	}
+	if len(lanes) == 0 {
+		return nil, fmt.Errorf("bond %s: no interfaces to bond: %w", lb.Name, syscall.ENETUNREACH)
+	}
+	ctx, cancel := context.WithTimeout(ctx, backendDialTimeout)
+	defer cancel()
+
+	hello := &bondHello{Time: time.Now().Unix(), Target: remoteAddr}
+	rand.Read(hello.Session[:])
+	key := bondKey(lb)
+
+	type result struct {
+		lane   *bondLane
+		rep    byte
+		remote string
+		err    error
+	}
+	results := make(chan result, len(lanes))
+	for i, b := range lanes {
+		h := *hello
+		h.Lane = uint8(i)
+		go func() {
+			c, err := dialVia(ctx, b, lb.Upstream.Host)
+			if err != nil {
+				results <- result{err: fmt.Errorf("lane %s: %w", b.Name, err)}
+				return
+			}
+			// L'annullamento di ctx interrompe anche la negoziazione
+			stop := context.AfterFunc(ctx, func() { c.SetDeadline(time.Now()) })
+			defer stop()
+			var rep byte
+			var addr string
+			_, err = c.Write(h.encode(key))
+			if err == nil {
+				rep, addr, err = readBondReply(c)
+			}
+			if err == nil && rep != socksRepSuccess {
+				err = fmt.Errorf("relay %s: %w", lb.Upstream.Host, socksReplyError(rep))
+			}
+			if err != nil || !stop() {
+				c.Close()
+				results <- result{rep: rep, err: err}
+				return
+			}
+			c.SetDeadline(time.Time{})
+			results <- result{lane: &bondLane{conn: c, stats: b.Stats}, remote: addr}
+		}()
+	}
+
+	var ready []*bondLane
+	var remote string
+	var firstErr, relayErr error
+	var grace <-chan time.Time
+	for pending := len(lanes); pending > 0; pending-- {
+		var r result
+		select {
+		case r = <-results:
+		case <-grace:
+			cancel()
+			r = <-results
+		}
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if relayErr == nil && r.rep != socksRepSuccess {
+				relayErr = r.err // il verdetto del relay spiega più di un dial annullato
+			}
+			continue
+		}
+		ready = append(ready, r.lane)
+		remote = r.remote
+		if grace == nil {
+			grace = time.After(bondLaneGrace)
+		}
+	}
+	if len(ready) == 0 {
+		if relayErr != nil {
+			return nil, relayErr
+		}
+		return nil, firstErr
+	}
+	c := newBondConn(ready[0].conn.LocalAddr(), remote)
+	attached := 0
+	for _, l := range ready {
+		if _, err := l.conn.Write(bondFrame(bondFrameReady, 0, nil)); err != nil {
+			l.conn.Close()
+			firstErr = err
+			continue
+		}
+		if c.attach(l) {
+			attached++
+		}
+	}
+	if attached == 0 {
+		c.Close()
+		return nil, firstErr
+	}
+	return c, nil
+}
+
+// bondLane è un tunnel della connessione; stats, se presente, conta i byte del backend
+// da cui è uscito
+type bondLane struct {
+	conn  net.Conn
+	stats *BackendStats
+}
+
+type bondRecv struct {
+	data []byte
+	fin  bool
+}
+
+// bondConn è una connessione ricomposta da più lane. Write divide i dati in frame numerati
+// messi in una coda comune da cui le lane pescano; Read restituisce i frame ricevuti in
+// ordine di sequenza. La caduta di una lane interrompe l'intera connessione: i frame che
+// portava non si possono recuperare.
+type bondConn struct {
+	local  net.Addr
+	remote net.Addr
+
+	out     chan []byte
+	pending sync.WaitGroup // frame accodati e non ancora scritti
+	wmu     sync.Mutex
+	sendSeq uint64
+	finSent bool
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	lanes    []*bondLane
+	open     int // lane con il lettore ancora attivo
+	recv     map[uint64]bondRecv
+	next     uint64
+	cur      []byte
+	finRecvd bool
+	eof      bool
+	err      error
+
+	done      chan struct{}
+	closeOnce sync.Once
+	closed    atomic.Bool
+}
+
+func newBondConn(local net.Addr, remote string) *bondConn {
+	c := &bondConn{
+		local: local,
+		out:   make(chan []byte, 4),
+		recv:  make(map[uint64]bondRecv),
+		done:  make(chan struct{}),
+	}
+	if addr, err := net.ResolveTCPAddr("tcp", remote); err == nil && addr.IP != nil {
+		c.remote = addr
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// attach aggiunge una lane pronta e ne avvia lettore e scrittore; false se la
+// connessione è già chiusa
+func (c *bondConn) attach(l *bondLane) bool {
+	setBondSendLowat(l.conn)
+	c.mu.Lock()
+	if c.err != nil || c.closed.Load() {
+		c.mu.Unlock()
+		l.conn.Close()
+		return false
+	}
+	c.lanes = append(c.lanes, l)
+	c.open++
+	if c.remote == nil {
+		c.remote = l.conn.RemoteAddr()
+	}
+	c.mu.Unlock()
+	go c.readLane(l)
+	go c.writeLane(l)
+	return true
+}
+
+func (c *bondConn) writeLane(l *bondLane) {
+	for {
+		select {
+		case f := <-c.out:
+			_, err := l.conn.Write(f)
+			c.pending.Done()
+			if err != nil {
+				c.fail(err)
+				return
+			}
+			if l.stats != nil {
+				l.stats.BytesUp.Add(uint64(len(f)))
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *bondConn) readLane(l *bondLane) {
+	br := bufio.NewReaderSize(l.conn, 64<<10)
+	var hdr [bondFrameHdr]byte
+	for {
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			c.laneEnded(err)
+			return
+		}
+		typ, seq := hdr[0], binary.BigEndian.Uint64(hdr[3:])
+		data := make([]byte, binary.BigEndian.Uint16(hdr[1:]))
+		if _, err := io.ReadFull(br, data); err != nil {
+			c.laneEnded(err)
+			return
+		}
+		if l.stats != nil {
+			l.stats.BytesDown.Add(uint64(len(hdr) + len(data)))
+		}
+		if typ != bondFrameData && typ != bondFrameFin {
+			c.fail(fmt.Errorf("bond: unexpected frame type %d", typ))
+			return
+		}
+
+		c.mu.Lock()
+		// Una lane troppo avanti aspetta le altre; quella che porta il frame atteso
+		// non si ferma mai, perché ogni lane riceve i frame in ordine crescente
+		for seq >= c.next+bondWindow && c.err == nil && !c.closed.Load() {
+			c.cond.Wait()
+		}
+		if c.err != nil || c.closed.Load() {
+			c.mu.Unlock()
+			return
+		}
+		if _, dup := c.recv[seq]; dup || seq < c.next || c.finRecvd && typ == bondFrameFin {
+			c.mu.Unlock()
+			c.fail(fmt.Errorf("bond: duplicate frame %d", seq))
+			return
+		}
+		c.recv[seq] = bondRecv{data: data, fin: typ == bondFrameFin}
+		c.finRecvd = c.finRecvd || typ == bondFrameFin
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	}
+}
+
+// laneEnded registra la fine di una lane: un EOF è normale quando il peer chiude dopo
+// la fine dei dati, qualsiasi altro errore interrompe la connessione
+func (c *bondConn) laneEnded(err error) {
+	if c.closed.Load() {
+		return
+	}
+	if err != io.EOF {
+		c.fail(err)
+		return
+	}
+	c.mu.Lock()
+	c.open--
+	c.cond.Broadcast()
+	c.mu.Unlock()
+}
+
+// fail interrompe la connessione chiudendo tutte le lane
+func (c *bondConn) fail(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	c.shutdown()
+}
+
+func (c *bondConn) shutdown() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.mu.Lock()
+		lanes := c.lanes
+		c.mu.Unlock()
+		for _, l := range lanes {
+			l.conn.Close()
+		}
+	})
+}
+
+func (c *bondConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		switch {
+		case len(c.cur) > 0:
+			n := copy(p, c.cur)
+			c.cur = c.cur[n:]
+			return n, nil
+		case c.eof:
+			return 0, io.EOF
+		case c.closed.Load():
+			return 0, net.ErrClosed
+		}
+		if f, ok := c.recv[c.next]; ok {
+			delete(c.recv, c.next)
+			c.next++
+			c.cond.Broadcast()
+			c.cur, c.eof = f.data, f.fin
+			continue
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		if c.open == 0 && len(c.lanes) > 0 {
+			// Tutte le lane chiuse senza il frame di fine: il peer ha interrotto
+			return 0, io.ErrUnexpectedEOF
+		}
+		c.cond.Wait()
+	}
+}
+
+func (c *bondConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.finSent {
+		return 0, net.ErrClosed
+	}
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), bondFrameMax)
+		if err := c.send(bondFrame(bondFrameData, c.sendSeq, p[:n])); err != nil {
+			return written, err
+		}
+		p, written = p[n:], written+n
+	}
+	return written, nil
+}
+
+// send accoda un frame e ne consuma il numero di sequenza; va chiamata con wmu acquisito
+func (c *bondConn) send(f []byte) error {
+	c.pending.Add(1)
+	select {
+	case c.out <- f:
+		c.sendSeq++
+		return nil
+	case <-c.done:
+		c.pending.Done()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.err != nil {
+			return c.err
+		}
+		return net.ErrClosed
+	}
+}
+
+// CloseWrite invia il frame di fine: il peer leggerà EOF dopo gli ultimi dati
+func (c *bondConn) CloseWrite() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.finSent {
+		return nil
+	}
+	if err := c.send(bondFrame(bondFrameFin, c.sendSeq, nil)); err != nil {
+		return err
+	}
+	c.finSent = true
+	return nil
+}
+
+// Close chiude le lane; dopo CloseWrite aspetta prima che i frame in coda siano scritti,
+// altrimenti il peer vedrebbe le lane chiudersi senza il frame di fine
+func (c *bondConn) Close() error {
+	c.wmu.Lock()
+	graceful := c.finSent
+	c.wmu.Unlock()
+	if graceful {
+		flushed := make(chan struct{})
+		go func() {
+			c.pending.Wait()
+			close(flushed)
+		}()
+		select {
+		case <-flushed:
+		case <-c.done:
+		case <-time.After(bondCloseWait):
+		}
+	}
+	c.closed.Store(true)
+	c.mu.Lock()
+	c.cond.Broadcast()
+	c.mu.Unlock()
+	c.shutdown()
+	return nil
+}
+
+func (c *bondConn) LocalAddr() net.Addr  { return c.local }
+func (c *bondConn) RemoteAddr() net.Addr { return c.remote }
+
+// Le scadenze valgono per le singole lane: una lane scaduta interrompe la connessione
+func (c *bondConn) SetDeadline(t time.Time) error {
+	return c.eachLane(func(l net.Conn) error { return l.SetDeadline(t) })
+}
+
+func (c *bondConn) SetReadDeadline(t time.Time) error {
+	return c.eachLane(func(l net.Conn) error { return l.SetReadDeadline(t) })
+}
+
+func (c *bondConn) SetWriteDeadline(t time.Time) error {
+	return c.eachLane(func(l net.Conn) error { return l.SetWriteDeadline(t) })
+}
+
+func (c *bondConn) eachLane(fn func(net.Conn) error) error {
+	c.mu.Lock()
+	lanes := c.lanes
+	c.mu.Unlock()
+	for _, l := range lanes {
+		if err := fn(l.conn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
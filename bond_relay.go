@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	bondHelloTimeout   = 10 * time.Second // hello, dial della destinazione e frame "ready"
+	bondSessionLinger  = 2 * bondMaxSkew  // una sessione chiusa non si può riaprire con lo stesso ID
+	bondRelayKeepAlive = 30 * time.Second
+)
+
+// runBondRelay avvia il relay del bonding: accetta le lane dei client dispatch-proxy
+// configurati con un backend bond://, ricompone ogni connessione e la inoltra alla destinazione
+func runBondRelay(args []string) error {
+	fs := flag.NewFlagSet("bond-relay", flag.ContinueOnError)
+	listen := fs.String("listen", ":"+bondDefaultPort, "address to listen on for client lanes")
+	key := fs.String("key", os.Getenv("DISPATCH_BOND_KEY"), "shared key, the password in the client's bond://:key@host URL (default $DISPATCH_BOND_KEY)")
+	idle := fs.Duration("idle-timeout", 5*time.Minute, "close relayed connections with no traffic in either direction for this long (0 disables)")
+	verbose := fs.Bool("v", false, "log every connection")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *key == "" {
+		return errors.New("missing -key: without it anyone reaching the port could use the relay as an open proxy")
+	}
+	level := slog.LevelInfo
+	if *verbose {
+		level = slog.LevelDebug
+	}
+	r := &bondRelay{
+		key:      []byte(*key),
+		idle:     *idle,
+		log:      slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})),
+		sessions: make(map[[bondSessionLen]byte]*bondSession),
+	}
+	lc := net.ListenConfig{KeepAlive: bondRelayKeepAlive}
+	l, err := lc.Listen(context.Background(), "tcp", *listen)
+	if err != nil {
+		return err
+	}
+	r.log.Info("bond relay listening", "listen", l.Addr().String())
+	// Nell'URL la chiave va codificata: spazi e simboli come @ o / non sono ammessi
+	fmt.Fprintf(os.Stderr, "use it with: dispatch-proxy -upstream 'bond://%s@<this host>:%d'\n",
+		url.UserPassword("", *key), l.Addr().(*net.TCPAddr).Port)
+	return r.serve(l)
+}
+
+// serve accetta le lane dei client finché il listener non viene chiuso
+func (r *bondRelay) serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		go r.handleLane(c)
+	}
+}
+
+type bondRelay struct {
+	key  []byte
+	idle time.Duration
+	log  *slog.Logger
+
+	mu       sync.Mutex
+	sessions map[[bondSessionLen]byte]*bondSession
+}
+
+// bondSession è una connessione ricomposta dal relay: la prima lane la crea e apre la
+// connessione verso la destinazione, le altre si aggiungono
+type bondSession struct {
+	id      string
+	target  string
+	ready   chan struct{} // chiuso quando il dial della destinazione è terminato
+	rep     byte
+	remote  net.Conn
+	conn    *bondConn
+	lanes   map[uint8]bool // lane già presentate: un hello ripetuto viene rifiutato
+	started bool           // prima lane agganciata: il relay è partito
+	ended   time.Time      // chiusa, tenuta per bondSessionLinger
+}
+
+func (r *bondRelay) handleLane(c net.Conn) {
+	c.SetDeadline(time.Now().Add(bondHelloTimeout))
+	h, err := readBondHello(c, r.key)
+	if err != nil {
+		if err != io.EOF {
+			r.log.Warn("lane rejected", "client", c.RemoteAddr().String(), "error", err)
+		}
+		if errors.Is(err, errBondAuth) {
+			c.Write(bondReply(socksRepNotAllowed, nil))
+		}
+		c.Close()
+		return
+	}
+
+	sess, fresh := r.session(h)
+	if sess == nil {
+		r.log.Warn("lane rejected", "client", c.RemoteAddr().String(), "lane", h.Lane,
+			"error", "session already ended or lane already joined (replayed hello?)")
+		c.Write(bondReply(socksRepGeneralFailure, nil))
+		c.Close()
+		return
+	}
+	if fresh {
+		go r.dial(sess)
+	}
+	<-sess.ready
+	var addr net.Addr
+	if sess.remote != nil {
+		addr = sess.remote.RemoteAddr()
+	}
+	if _, err := c.Write(bondReply(sess.rep, addr)); err != nil || sess.rep != socksRepSuccess {
+		c.Close()
+		return
+	}
+
+	// Il client conferma le lane che usa; le altre (arrivate tardi) le chiude
+	var hdr [bondFrameHdr]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil || hdr[0] != bondFrameReady {
+		c.Close()
+		return
+	}
+	c.SetDeadline(time.Time{})
+	if !sess.conn.attach(&bondLane{conn: c}) {
+		return
+	}
+	r.log.Debug("lane joined", "session", sess.id, "lane", h.Lane, "client", c.RemoteAddr().String())
+
+	r.mu.Lock()
+	first := !sess.started
+	sess.started = true
+	r.mu.Unlock()
+	if first {
+		r.relay(sess)
+	}
+}
+
+// session restituisce la sessione dell'hello, creandola se è nuova (fresh); nil se
+// è già terminata o se la lane si è già presentata. La sessione chiusa resta in memoria
+// oltre la tolleranza dell'ora, quindi anche un hello ripetuto più tardi viene rifiutato.
+func (r *bondRelay) session(h *bondHello) (sess *bondSession, fresh bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, s := range r.sessions {
+		if !s.ended.IsZero() && time.Since(s.ended) > bondSessionLinger {
+			delete(r.sessions, id)
+		}
+	}
+	if s, ok := r.sessions[h.Session]; ok {
+		if !s.ended.IsZero() || s.lanes[h.Lane] {
+			return nil, false
+		}
+		s.lanes[h.Lane] = true
+		return s, false
+	}
+	s := &bondSession{
+		id:     hex.EncodeToString(h.Session[:4]),
+		target: h.Target,
+		ready:  make(chan struct{}),
+		lanes:  map[uint8]bool{h.Lane: true},
+	}
+	r.sessions[h.Session] = s
+	return s, true
+}
+
+// dial apre la connessione verso la destinazione; se nessuna lane si aggancia entro
+// bondHelloTimeout la sessione viene chiusa
+func (r *bondRelay) dial(s *bondSession) {
+	d := net.Dialer{Timeout: backendDialTimeout, KeepAlive: bondRelayKeepAlive}
+	remote, err := d.Dial("tcp", s.target)
+	if err != nil {
+		s.rep = socksReplyCode(err)
+		r.log.Debug("dial failed", "session", s.id, "dest", s.target, "error", err)
+		close(s.ready)
+		r.end(s)
+		return
+	}
+	s.remote = remote
+	s.conn = newBondConn(remote.LocalAddr(), "")
+	close(s.ready)
+
+	time.AfterFunc(bondHelloTimeout, func() {
+		r.mu.Lock()
+		orphan := !s.started
+		r.mu.Unlock()
+		if orphan {
+			remote.Close()
+			s.conn.Close()
+			r.end(s)
+		}
+	})
+}
+
+func (r *bondRelay) relay(s *bondSession) {
+	start := time.Now()
+	r.log.Debug("connection opened", "session", s.id, "dest", s.target)
+	var cs ConnStats
+	reason := pipe(s.conn, s.remote, &cs, &BackendStats{}, r.idle)
+	s.conn.mu.Lock()
+	lanes := len(s.conn.lanes)
+	s.conn.mu.Unlock()
+	r.log.Info("connection closed", "session", s.id, "dest", s.target, "lanes", lanes,
+		"up", cs.BytesUp.Load(), "down", cs.BytesDown.Load(),
+		"duration", time.Since(start).Round(time.Millisecond), "reason", reason)
+	r.end(s)
+}
+
+func (r *bondRelay) end(s *bondSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s.ended.IsZero() {
+		s.ended = time.Now()
+	}
+}
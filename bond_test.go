@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const testBondKey = "test key/with@symbols"
+
+// startBondRelay avvia un relay del bonding su 127.0.0.1 e ne restituisce l'indirizzo
+func startBondRelay(t *testing.T) (*bondRelay, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	r := &bondRelay{
+		key:      []byte(testBondKey),
+		log:      slog.New(slog.DiscardHandler),
+		sessions: make(map[[bondSessionLen]byte]*bondSession),
+	}
+	go r.serve(l)
+	return r, l.Addr().String()
+}
+
+// bondBackend è un backend bond:// verso relay con due lane su loopback; la chiave
+// passa dall'URL codificato come quello suggerito dal relay
+func bondBackend(t *testing.T, relay, key string) *Backend {
+	t.Helper()
+	reg := NewMetricsRegistry()
+	lanes := []*Backend{loopbackBackend(net.IPv4(127, 0, 0, 1), nil), loopbackBackend(net.IPv4(127, 0, 0, 1), nil)}
+	for i, l := range lanes {
+		l.Stats = reg.Backend(l.Name+string(rune('0'+i)), "lo")
+	}
+	u, err := parseUpstream("bond://" + url.UserPassword("", key).String() + "@" + relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(bondKey(&Backend{Upstream: u})) != key {
+		t.Fatalf("key %q did not survive the URL", key)
+	}
+	return &Backend{Name: upstreamName(u), Upstream: u, Stats: reg.Backend("bond", ""), bondLanes: func() []*Backend { return lanes }}
+}
+
+// bondTarget è la destinazione: handle riceve ogni connessione accettata
+func bondTarget(t *testing.T, handle func(c *net.TCPConn)) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				handle(c.(*net.TCPConn))
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func dialTestBond(t *testing.T, relay, target string) *bondConn {
+	t.Helper()
+	c, err := dialBond(context.Background(), bondBackend(t, relay, testBondKey), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(10 * time.Second))
+	return c.(*bondConn)
+}
+
+func TestBondStreamBothDirections(t *testing.T) {
+	_, relay := startBondRelay(t)
+	up := make([]byte, 3<<20+7)
+	down := make([]byte, 2<<20+123)
+	rand.Read(up)
+	rand.Read(down)
+	gotUp := make(chan []byte, 1)
+	target := bondTarget(t, func(c *net.TCPConn) {
+		b, _ := io.ReadAll(c)
+		gotUp <- b
+		c.Write(down)
+		c.CloseWrite()
+	})
+
+	c := dialTestBond(t, relay, target)
+	c.mu.Lock()
+	lanes := len(c.lanes)
+	c.mu.Unlock()
+	if lanes != 2 {
+		t.Errorf("lanes = %d, want 2", lanes)
+	}
+	if _, err := c.Write(up); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	gotDown, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(<-gotUp, up) {
+		t.Error("upload differs")
+	}
+	if !bytes.Equal(gotDown, down) {
+		t.Errorf("download differs (%d bytes, want %d)", len(gotDown), len(down))
+	}
+}
+
+func TestBondHalfCloseFromTarget(t *testing.T) {
+	_, relay := startBondRelay(t)
+	gotUp := make(chan []byte, 1)
+	target := bondTarget(t, func(c *net.TCPConn) {
+		c.Write([]byte("hello"))
+		c.CloseWrite()
+		b, _ := io.ReadAll(c)
+		gotUp <- b
+	})
+
+	c := dialTestBond(t, relay, target)
+	// Il target ha chiuso in scrittura: EOF qui, ma si può ancora inviare
+	got, err := io.ReadAll(c)
+	if err != nil || string(got) != "hello" {
+		t.Fatalf("read %q, %v", got, err)
+	}
+	if _, err := c.Write([]byte("still here")); err != nil {
+		t.Fatal(err)
+	}
+	c.CloseWrite()
+	select {
+	case b := <-gotUp:
+		if string(b) != "still here" {
+			t.Errorf("target received %q", b)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("target did not receive the data sent after the half-close")
+	}
+}
+
+func TestBondLaneFailure(t *testing.T) {
+	_, relay := startBondRelay(t)
+	targetDone := make(chan error, 1)
+	target := bondTarget(t, func(c *net.TCPConn) {
+		_, err := io.Copy(io.Discard, c)
+		targetDone <- err
+	})
+
+	c := dialTestBond(t, relay, target)
+	if _, err := c.Write([]byte("some data")); err != nil {
+		t.Fatal(err)
+	}
+	c.mu.Lock()
+	c.lanes[0].conn.Close()
+	c.mu.Unlock()
+
+	// La connessione cade per intero, da entrambi i lati, senza un EOF pulito
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(c)
+		readErr <- err
+	}()
+	select {
+	case err := <-readErr:
+		if err == nil {
+			t.Error("read ended with a clean EOF after a lane failure")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client read still blocked after a lane failure")
+	}
+	select {
+	case <-targetDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay kept the target connection open")
+	}
+}
+
+// laneHello invia un hello già codificato al relay e ne restituisce la risposta
+func laneHello(t *testing.T, relay string, hello []byte) (byte, net.Conn) {
+	t.Helper()
+	c, err := net.Dial("tcp", relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write(hello); err != nil {
+		t.Fatal(err)
+	}
+	rep, _, err := readBondReply(c)
+	if err != nil {
+		t.Fatalf("reading the reply: %v", err)
+	}
+	return rep, c
+}
+
+func TestBondWrongKey(t *testing.T) {
+	_, relay := startBondRelay(t)
+	target := bondTarget(t, func(c *net.TCPConn) {})
+
+	h := &bondHello{Time: time.Now().Unix(), Target: target}
+	rand.Read(h.Session[:])
+	if rep, _ := laneHello(t, relay, h.encode([]byte("wrong key"))); rep != socksRepNotAllowed {
+		t.Errorf("reply = %#x, want %#x", rep, socksRepNotAllowed)
+	}
+	if _, err := dialBond(context.Background(), bondBackend(t, relay, "wrong key"), target); !errors.Is(err, syscall.EACCES) {
+		t.Errorf("dialBond error = %v, want not allowed", err)
+	}
+}
+
+func TestBondReplay(t *testing.T) {
+	r, relay := startBondRelay(t)
+	target := bondTarget(t, func(c *net.TCPConn) { io.Copy(io.Discard, c) })
+
+	h := &bondHello{Time: time.Now().Unix(), Target: target}
+	rand.Read(h.Session[:])
+	hello := h.encode([]byte(testBondKey))
+	rep, first := laneHello(t, relay, hello)
+	if rep != socksRepSuccess {
+		t.Fatalf("first hello: reply %#x", rep)
+	}
+	first.Write(bondFrame(bondFrameReady, 0, nil))
+
+	// Lo stesso hello ripetuto mentre la sessione è aperta
+	if rep, _ := laneHello(t, relay, hello); rep != socksRepGeneralFailure {
+		t.Errorf("replay while open: reply %#x, want %#x", rep, socksRepGeneralFailure)
+	}
+	// La lane è coperta dall'HMAC: cambiarla invalida l'hello
+	tampered := bytes.Clone(hello)
+	tampered[len(bondMagic)+bondSessionLen]++
+	if rep, _ := laneHello(t, relay, tampered); rep != socksRepNotAllowed {
+		t.Errorf("hello with a changed lane: reply %#x, want %#x", rep, socksRepNotAllowed)
+	}
+	// Una lane nuova della stessa sessione, firmata con la chiave, resta valida
+	h.Lane = 1
+	if rep, _ := laneHello(t, relay, h.encode([]byte(testBondKey))); rep != socksRepSuccess {
+		t.Errorf("second lane: reply %#x, want success", rep)
+	}
+
+	// Chiusa la sessione, l'hello viene rifiutato finché l'ora è ancora in tolleranza
+	first.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.mu.Lock()
+		sess := r.sessions[h.Session]
+		ended := !sess.ended.IsZero()
+		if ended {
+			sess.ended = time.Now().Add(-bondMaxSkew - time.Minute)
+		}
+		r.mu.Unlock()
+		if ended {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("session did not end")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rep, _ := laneHello(t, relay, hello); rep != socksRepGeneralFailure {
+		t.Errorf("replay after the session ended: reply %#x, want %#x", rep, socksRepGeneralFailure)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// subcommand è un comando eseguito al posto dell'applicazione: dispatch-proxy <nome> [flag]
+type subcommand struct {
+	summary string
+	run     func(args []string) error
+}
+
+var subcommands = map[string]subcommand{
+	"download":         {"download a file over all interfaces at once, in segments, with resume", runDownload},
+	"bond-relay":       {"relay server that reassembles connections striped over several interfaces by a bond:// backend", runBondRelay},
+	"speedtest-server": {"serve downloads and accept uploads for the per-interface speed test, offline", runSpeedTestServer},
+}
+
+// runSubcommand esegue il sottocomando indicato come primo argomento; false se non ce n'è uno
+func runSubcommand() bool {
+	if len(os.Args) < 2 {
+		return false
+	}
+	cmd, ok := subcommands[os.Args[1]]
+	if !ok {
+		return false
+	}
+	if err := cmd.run(os.Args[2:]); err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+		}
+		os.Exit(1)
+	}
+	return true
+}
+
+// usage aggiunge l'elenco dei sottocomandi all'help dei flag
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags]\n       %s <command> [flags]\n\nFlags:\n", os.Args[0], os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintln(out, "\nCommands:")
+	names := make([]string, 0, len(subcommands))
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %-14s %s\n", name, subcommands[name].summary)
+	}
+}
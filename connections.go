@@ -0,0 +1,197 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnInfo descrive una connessione attiva inoltrata dal proxy
+type ConnInfo struct {
+	ConnStats
+
+	ID       uint64
+	Method   string
+	Client   string
+	Dest     string // destinazione richiesta dal client (dominio o IP)
+	RemoteIP string // indirizzo effettivamente connesso
+	MPTCP    bool   // MPTCP negoziato con il server
+	Backend  string
+	LBIndex  int
+	Start    time.Time
+	DialTime time.Duration
+
+	CloseReason string
+
+	client, remote net.Conn
+	killed         atomic.Bool // chiusa da GUI o API
+
+	// Rate in byte/s, aggiornati dal sampler
+	rateUp, rateDown atomic.Uint64
+	prevUp, prevDown uint64
+}
+
+// ConnSnapshot è una copia immutabile di ConnInfo per GUI e API
+type ConnSnapshot struct {
+	ID        uint64    `json:"id"`
+	Client    string    `json:"client"`
+	Dest      string    `json:"dest"`
+	RemoteIP  string    `json:"remote_ip"`
+	MPTCP     bool      `json:"mptcp"`
+	Backend   string    `json:"backend"`
+	LBIndex   int       `json:"lb_index"`
+	Start     time.Time `json:"start"`
+	BytesUp   uint64    `json:"bytes_up"`
+	BytesDown uint64    `json:"bytes_down"`
+	RateUp    uint64    `json:"rate_up"`   // byte/s
+	RateDown  uint64    `json:"rate_down"` // byte/s
+}
+
+// ConnTracker tiene l'elenco delle connessioni attive. Lo zero value è pronto all'uso.
+type ConnTracker struct {
+	mu    sync.Mutex
+	conns map[uint64]*ConnInfo
+}
+
+// Add registra una connessione; l'ID lo assegna il proxy all'accept
+func (t *ConnTracker) Add(ci *ConnInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns == nil {
+		t.conns = make(map[uint64]*ConnInfo)
+	}
+	t.conns[ci.ID] = ci
+}
+
+func (t *ConnTracker) Remove(id uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, id)
+}
+
+// Close chiude la connessione indicata; restituisce false se non esiste
+func (t *ConnTracker) Close(id uint64) bool {
+	t.mu.Lock()
+	ci, ok := t.conns[id]
+	t.mu.Unlock()
+	if !ok {
+		return false
+	}
+	ci.killed.Store(true)
+	ci.client.Close()
+	ci.remote.Close()
+	return true
+}
+
+// CloseBackend chiude tutte le connessioni che passano dal backend indicato
+func (t *ConnTracker) CloseBackend(backend string) int {
+	t.mu.Lock()
+	var victims []*ConnInfo
+	for _, ci := range t.conns {
+		if ci.Backend == backend {
+			victims = append(victims, ci)
+		}
+	}
+	t.mu.Unlock()
+	for _, ci := range victims {
+		ci.killed.Store(true)
+		ci.client.Close()
+		ci.remote.Close()
+	}
+	return len(victims)
+}
+
+// sampleRates calcola i rate per connessione; va chiamata a intervalli regolari
+func (t *ConnTracker) sampleRates(interval time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	secs := interval.Seconds()
+	for _, ci := range t.conns {
+		up, down := ci.BytesUp.Load(), ci.BytesDown.Load()
+		ci.rateUp.Store(uint64(float64(up-ci.prevUp) / secs))
+		ci.rateDown.Store(uint64(float64(down-ci.prevDown) / secs))
+		ci.prevUp, ci.prevDown = up, down
+	}
+}
+
+func (t *ConnTracker) Snapshot() []ConnSnapshot {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	list := make([]ConnSnapshot, 0, len(t.conns))
+	for _, ci := range t.conns {
+		list = append(list, ConnSnapshot{
+			ID:        ci.ID,
+			Client:    ci.Client,
+			Dest:      ci.Dest,
+			RemoteIP:  ci.RemoteIP,
+			MPTCP:     ci.MPTCP,
+			Backend:   ci.Backend,
+			LBIndex:   ci.LBIndex,
+			Start:     ci.Start,
+			BytesUp:   ci.BytesUp.Load(),
+			BytesDown: ci.BytesDown.Load(),
+			RateUp:    ci.rateUp.Load(),
+			RateDown:  ci.rateDown.Load(),
+		})
+	}
+	return list
+}
+
+// FilterConns tiene le connessioni del backend indicato (se non vuoto)
+// che contengono text in client, destinazione o indirizzo remoto
+func FilterConns(list []ConnSnapshot, text, backend string) []ConnSnapshot {
+	text = strings.ToLower(strings.TrimSpace(text))
+	out := list[:0]
+	for _, c := range list {
+		if backend != "" && c.Backend != backend {
+			continue
+		}
+		if text != "" &&
+			!strings.Contains(strings.ToLower(c.Client), text) &&
+			!strings.Contains(strings.ToLower(c.Dest), text) &&
+			!strings.Contains(strings.ToLower(c.RemoteIP), text) {
+			continue
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// SortConns ordina per la chiave indicata; chiavi sconosciute ordinano per id
+func SortConns(list []ConnSnapshot, key string, desc bool) {
+	less := func(a, b ConnSnapshot) bool {
+		switch key {
+		case "client":
+			return a.Client < b.Client
+		case "dest":
+			return a.Dest < b.Dest
+		case "remote":
+			return a.RemoteIP < b.RemoteIP
+		case "mptcp":
+			return !a.MPTCP && b.MPTCP
+		case "backend":
+			return a.Backend < b.Backend
+		case "start":
+			return a.Start.Before(b.Start)
+		case "up":
+			return a.BytesUp < b.BytesUp
+		case "down":
+			return a.BytesDown < b.BytesDown
+		case "rate_up":
+			return a.RateUp < b.RateUp
+		case "rate_down":
+			return a.RateDown < b.RateDown
+		default:
+			return a.ID < b.ID
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if desc {
+			return less(list[j], list[i])
+		}
+		return less(list[i], list[j])
+	})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func testConns() []ConnSnapshot {
+	t0 := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	return []ConnSnapshot{
+		{ID: 1, Client: "127.0.0.1:5001", Dest: "example.com:443", RemoteIP: "93.184.216.34", Backend: "usb0", Start: t0.Add(2 * time.Second), BytesUp: 300, BytesDown: 10, RateDown: 5},
+		{ID: 2, Client: "127.0.0.1:5002", Dest: "Files.Example.org:80", RemoteIP: "203.0.113.7", Backend: "wlan0", Start: t0, BytesUp: 100, BytesDown: 30, RateDown: 1},
+		{ID: 3, Client: "192.168.1.9:6000", Dest: "[2001:db8::1]:22", RemoteIP: "2001:db8::1", Backend: "usb0", Start: t0.Add(time.Second), BytesUp: 200, BytesDown: 20, RateDown: 9},
+	}
+}
+
+func connIDs(list []ConnSnapshot) []uint64 {
+	ids := make([]uint64, len(list))
+	for i, c := range list {
+		ids[i] = c.ID
+	}
+	return ids
+}
+
+func TestFilterConns(t *testing.T) {
+	tests := []struct {
+		text, backend string
+		want          []uint64
+	}{
+		{"", "", []uint64{1, 2, 3}},
+		{"", "usb0", []uint64{1, 3}},
+		{"example", "", []uint64{1, 2}},
+		{"  EXAMPLE.ORG ", "", []uint64{2}}, // senza distinzione di maiuscole e spazi
+		{"203.0.113", "", []uint64{2}},      // indirizzo remoto
+		{"192.168.1.9", "", []uint64{3}},    // client
+		{"example", "usb0", []uint64{1}},
+		{"nothing", "", []uint64{}},
+	}
+	for _, tt := range tests {
+		got := connIDs(FilterConns(testConns(), tt.text, tt.backend))
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("FilterConns(%q, %q) = %v, want %v", tt.text, tt.backend, got, tt.want)
+		}
+	}
+}
+
+func TestSortConns(t *testing.T) {
+	tests := []struct {
+		key  string
+		desc bool
+		want []uint64
+	}{
+		{"id", false, []uint64{1, 2, 3}},
+		{"id", true, []uint64{3, 2, 1}},
+		{"unknown", false, []uint64{1, 2, 3}},
+		{"client", false, []uint64{1, 2, 3}},
+		{"dest", false, []uint64{2, 3, 1}}, // ordine dei byte: "F" < "[" < "e"
+		{"remote", false, []uint64{3, 2, 1}},
+		{"backend", false, []uint64{1, 3, 2}}, // stabile a parità di chiave
+		{"backend", true, []uint64{2, 1, 3}},
+		{"start", false, []uint64{2, 3, 1}},
+		{"up", true, []uint64{1, 3, 2}},
+		{"down", false, []uint64{1, 3, 2}},
+		{"rate_down", true, []uint64{3, 1, 2}},
+	}
+	for _, tt := range tests {
+		list := testConns()
+		SortConns(list, tt.key, tt.desc)
+		if got := connIDs(list); !slices.Equal(got, tt.want) {
+			t.Errorf("SortConns(%q, desc=%v) = %v, want %v", tt.key, tt.desc, got, tt.want)
+		}
+	}
+}
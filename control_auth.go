@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// randomToken genera il token usato quando non ne è configurato uno
+func randomToken() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// guard protegge il server di controllo: rifiuta gli Host che non indicano questa
+// macchina (DNS rebinding) e le richieste da altre origini, e richiede il token per
+// le API e /metrics. La dashboard statica è servita senza token.
+func (c *ControlServer) guard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allowedHost(r.Host) {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "host not allowed"})
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" && !sameOrigin(origin, r.Host) {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "cross-origin request"})
+			return
+		}
+		if (strings.HasPrefix(r.URL.Path, "/api/") || r.URL.Path == "/metrics") && !c.authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="dispatch-proxy"`)
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "missing or wrong token"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorized controlla il bearer token; lo stream dei log lo accetta anche come
+// parametro ?token=, perché EventSource non può impostare header
+func (c *ControlServer) authorized(r *http.Request) bool {
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok && r.Method == http.MethodGet && r.URL.Path == "/api/logs" {
+		got, ok = r.URL.Query().Get("token"), true
+	}
+	return ok && subtle.ConstantTimeCompare([]byte(strings.TrimSpace(got)), []byte(c.token)) == 1
+}
+
+// allowedHost accetta indirizzi IP, localhost e il nome di questa macchina
+func allowedHost(hostport string) bool {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = strings.Trim(hostport, "[]")
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" {
+		return false
+	}
+	if net.ParseIP(host) != nil || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	name, err := os.Hostname()
+	if err != nil {
+		return false
+	}
+	name = strings.ToLower(name)
+	return host == name || host == name+".local"
+}
+
+// sameOrigin verifica che l'Origin del browser sia lo stesso host:porta della richiesta
+func sameOrigin(origin, host string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	return strings.EqualFold(u.Host, host)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestControlGuard(t *testing.T) {
+	c := &ControlServer{token: "secret"}
+	h := c.guard(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := []struct {
+		name, method, target, host, origin, auth string
+		want                                     int
+	}{
+		{"dashboard without token", "GET", "/", "127.0.0.1:9090", "", "", http.StatusOK},
+		{"api without token", "GET", "/api/status", "127.0.0.1:9090", "", "", http.StatusUnauthorized},
+		{"metrics without token", "GET", "/metrics", "127.0.0.1:9090", "", "", http.StatusUnauthorized},
+		{"wrong token", "POST", "/api/stop", "127.0.0.1:9090", "", "Bearer nope", http.StatusUnauthorized},
+		{"not a bearer token", "POST", "/api/stop", "127.0.0.1:9090", "", "Basic secret", http.StatusUnauthorized},
+		{"good token", "POST", "/api/stop", "127.0.0.1:9090", "", "Bearer secret", http.StatusOK},
+		{"ipv6 host", "GET", "/api/status", "[::1]:9090", "", "Bearer secret", http.StatusOK},
+		{"localhost", "GET", "/api/status", "localhost:9090", "", "Bearer secret", http.StatusOK},
+		{"same origin", "PUT", "/api/settings", "127.0.0.1:9090", "http://127.0.0.1:9090", "Bearer secret", http.StatusOK},
+		{"cross origin", "PUT", "/api/settings", "127.0.0.1:9090", "http://evil.example", "Bearer secret", http.StatusForbidden},
+		{"rebinding host", "GET", "/api/status", "evil.example:9090", "", "Bearer secret", http.StatusForbidden},
+		{"rebinding host on dashboard", "GET", "/", "evil.example:9090", "", "", http.StatusForbidden},
+		{"logs token in query", "GET", "/api/logs?token=secret", "127.0.0.1:9090", "", "", http.StatusOK},
+		{"query token elsewhere", "GET", "/api/status?token=secret", "127.0.0.1:9090", "", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		r.Host = tt.host
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestControlStopClosesLogStream(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	ctrl := NewController(&ProxyServer{}, NewLogRouter())
+	c := &ControlServer{}
+	if err := c.Start(addr, "secret", ctrl); err != nil {
+		t.Fatal(err)
+	}
+	ctrl.Logs.Publish("hello")
+
+	resp, err := http.Get("http://" + addr + "/api/logs?token=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	// La cronologia arriva subito: lo stream è aperto
+	if _, err := bufio.NewReader(resp.Body).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	c.Stop()
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Stop took %v with a log stream open", d)
+	}
+	ended := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, resp.Body)
+		close(ended)
+	}()
+	select {
+	case <-ended:
+	case <-time.After(2 * time.Second):
+		t.Fatal("log stream still open after Stop")
+	}
+
+	// La porta è di nuovo libera
+	if err := c.Start(addr, "secret", ctrl); err != nil {
+		t.Fatalf("restart: %v", err)
+	}
+	c.Stop()
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// dialRace apre la connessione su lb e, se dopo delay non ha ancora finito (o è già
+// fallito), avvia lo stesso dial su un secondo backend scelto dal dispatcher: vince
+// la prima connessione riuscita e l'altro tentativo viene annullato. Un SYN perso su
+// un telefono costa così delay invece dell'intero backendDialTimeout. Il tentativo
+// annullato non pesa sulle statistiche del suo backend; il vincitore le aggiorna come
+// un dial normale. Se falliscono entrambi restituisce l'errore del primo backend.
+func dialRace(d *Dispatcher, lb *Backend, idx int, remoteAddr string, delay time.Duration) (net.Conn, *Backend, int, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type result struct {
+		c   net.Conn
+		lb  *Backend
+		idx int
+		err error
+	}
+	results := make(chan result, 2)
+	dial := func(lb *Backend, idx int) {
+		c, err := dialVia(ctx, lb, remoteAddr)
+		results <- result{c, lb, idx, err}
+	}
+
+	go dial(lb, idx)
+	pending, raced := 1, false
+	race := func() {
+		raced = true
+		if alt, altIdx := d.Alternate(lb); alt != nil {
+			pending++
+			go dial(alt, altIdx)
+		}
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var first *result
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				if pending > 0 {
+					// Il perdente può connettersi mentre viene annullato
+					go func() {
+						if late := <-results; late.c != nil {
+							late.c.Close()
+						}
+					}()
+				}
+				return r.c, r.lb, r.idx, nil
+			}
+			if r.lb == lb || first == nil {
+				first = &r
+			}
+			if !raced {
+				race()
+			}
+		case <-timer.C:
+			if !raced {
+				race()
+			}
+		}
+	}
+	return nil, first.lb, first.idx, first.err
+}
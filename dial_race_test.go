@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeConnectProxy è un proxy HTTP CONNECT su loopback: con stall accetta le connessioni
+// ma non risponde mai, altrimenti risponde 200 e scrive il proprio nome nel tunnel
+func fakeConnectProxy(t *testing.T, name string, stall bool) (*url.URL, *atomic.Int32) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var accepted atomic.Int32
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		close(done)
+		l.Close()
+	})
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer c.Close()
+				if stall {
+					<-done
+					return
+				}
+				if _, err := http.ReadRequest(bufio.NewReader(c)); err != nil {
+					return
+				}
+				io.WriteString(c, "HTTP/1.1 200 OK\r\n\r\n"+name)
+				<-done
+			}()
+		}
+	}()
+	return &url.URL{Scheme: "http", Host: l.Addr().String()}, &accepted
+}
+
+// closedUpstream punta a una porta di loopback su cui non ascolta nessuno
+func closedUpstream(t *testing.T) *url.URL {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &url.URL{Scheme: "http", Host: l.Addr().String()}
+	l.Close()
+	return u
+}
+
+func upstreamBackends(upstreams ...*url.URL) []*Backend {
+	reg := NewMetricsRegistry()
+	list := make([]*Backend, len(upstreams))
+	for i, u := range upstreams {
+		name := "up" + string(rune('a'+i))
+		list[i] = &Backend{Name: name, Upstream: u, ContentionRatio: 1, Stats: reg.Backend(name, "")}
+	}
+	return list
+}
+
+// tunnelGreeting legge il nome che il proxy finto ha scritto nel tunnel
+func tunnelGreeting(t *testing.T, c net.Conn) string {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 8)
+	n, err := io.ReadAtLeast(c, buf, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
+
+func TestDialRace(t *testing.T) {
+	t.Run("slow primary loses", func(t *testing.T) {
+		slow, _ := fakeConnectProxy(t, "slow", true)
+		fast, _ := fakeConnectProxy(t, "fast", false)
+		list := upstreamBackends(slow, fast)
+		d := NewDispatcher(list)
+		start := time.Now()
+		c, lb, idx, err := dialRace(d, list[0], 0, "example.com:80", 50*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if lb != list[1] || idx != 1 || tunnelGreeting(t, c) != "fast" {
+			t.Errorf("winner = %s (%d), want the second backend", lb.Name, idx)
+		}
+		if el := time.Since(start); el > 2*time.Second {
+			t.Errorf("race took %v", el)
+		}
+		if list[0].Stats.consecutiveFails.Load() != 0 {
+			t.Error("cancelled attempt counted as a failure")
+		}
+	})
+
+	t.Run("fast primary does not race", func(t *testing.T) {
+		fast, _ := fakeConnectProxy(t, "fast", false)
+		other, otherAccepts := fakeConnectProxy(t, "other", false)
+		list := upstreamBackends(fast, other)
+		c, lb, _, err := dialRace(NewDispatcher(list), list[0], 0, "example.com:80", time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if lb != list[0] || tunnelGreeting(t, c) != "fast" {
+			t.Errorf("winner = %s, want the primary", lb.Name)
+		}
+		if n := otherAccepts.Load(); n != 0 {
+			t.Errorf("alternate dialled %d times", n)
+		}
+	})
+
+	t.Run("failed primary races at once", func(t *testing.T) {
+		fast, _ := fakeConnectProxy(t, "fast", false)
+		list := upstreamBackends(closedUpstream(t), fast)
+		start := time.Now()
+		c, lb, _, err := dialRace(NewDispatcher(list), list[0], 0, "example.com:80", time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if lb != list[1] {
+			t.Errorf("winner = %s, want the alternate", lb.Name)
+		}
+		if el := time.Since(start); el > 2*time.Second {
+			t.Errorf("race waited %v for the delay", el)
+		}
+	})
+
+	t.Run("both fail", func(t *testing.T) {
+		list := upstreamBackends(closedUpstream(t), closedUpstream(t))
+		c, lb, idx, err := dialRace(NewDispatcher(list), list[0], 0, "example.com:80", 10*time.Millisecond)
+		if err == nil {
+			c.Close()
+			t.Fatal("dial succeeded")
+		}
+		if lb != list[0] || idx != 0 {
+			t.Errorf("error attributed to %s (%d), want the primary", lb.Name, idx)
+		}
+	})
+}
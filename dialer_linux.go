@@ -3,29 +3,101 @@
 package main
 
 import (
+	"fmt"
 	"net"
 	"syscall"
-	"time"
 )
 
-func DialBackend(d *Dispatcher, remoteAddr string) (net.Conn, *Backend, int, error) {
-	lb, idx := d.Next()
-	localAddr, err := net.ResolveTCPAddr("tcp4", lb.Address)
+// Modi di binding selezionabili per interfaccia
+var bindModeChoices = []BindMode{BindAuto, BindDevice, BindSource, BindMark}
+
+// newBackendDialer prepara un dialer con sorgente l'indirizzo IPv4 o IPv6 del backend,
+// legato all'interfaccia secondo il modo scelto; gli errori di setsockopt fanno fallire il dial
+func newBackendDialer(lb *Backend, ipv6 bool) (*net.Dialer, error) {
+	localAddr, err := lb.localAddr(ipv6)
 	if err != nil {
-		return nil, lb, idx, err
+		return nil, err
 	}
 
-	dialer := net.Dialer{
-		LocalAddr: localAddr,
-		Timeout:   10 * time.Second,
-		Control: func(network, address string, c syscall.RawConn) error {
-			return c.Control(func(fd uintptr) {
-				if lb.Interface != "" {
-					syscall.BindToDevice(int(fd), lb.Interface)
+	mark, err := backendMark(lb)
+	if err != nil {
+		return nil, err
+	}
+	device := lb.bindMode() == BindDevice
+
+	d := &net.Dialer{
+		LocalAddr:       localAddr,
+		Timeout:         backendDialTimeout,
+		KeepAlive:       keepAlivePeriod(lb.keepAlive),
+		KeepAliveConfig: lb.keepAlive,
+	}
+	if device || mark != 0 {
+		d.Control = sockoptControl(func(fd int) error {
+			if device {
+				if err := syscall.BindToDevice(fd, lb.Interface); err != nil {
+					return fmt.Errorf("bind to device %s: %w", lb.Interface, err)
 				}
-			})
-		},
+			}
+			if mark != 0 {
+				if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_MARK, int(mark)); err != nil {
+					return fmt.Errorf("set mark %#x: %w", mark, err)
+				}
+			}
+			return nil
+		})
+	}
+	return d, nil
+}
+
+// sockoptControl adatta una funzione sul descrittore al callback Control del dialer
+func sockoptControl(fn func(fd int) error) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var opErr error
+		if err := c.Control(func(fd uintptr) { opErr = fn(int(fd)) }); err != nil {
+			return err
+		}
+		return opErr
+	}
+}
+
+// backendMark è il fwmark da impostare sui socket del backend: quello configurato o, nel
+// modo "mark", il numero della tabella creata dal policy routing; 0 se nessuno
+func backendMark(lb *Backend) (uint32, error) {
+	if lb.Mark != 0 {
+		return lb.Mark, nil
+	}
+	if lb.bindMode() != BindMark {
+		return 0, nil
+	}
+	iface, err := net.InterfaceByName(lb.Interface)
+	if err != nil {
+		return 0, fmt.Errorf("backend %s: %w", lb.Name, err)
+	}
+	return policyTable(iface.Index), nil
+}
+
+// probeBindToDevice verifica su un socket di prova se SO_BINDTODEVICE è permesso
+func probeBindToDevice() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	return syscall.BindToDevice(fd, "lo")
+}
+
+// tcpNotSentLowat è TCP_NOTSENT_LOWAT, assente dal pacchetto syscall
+const tcpNotSentLowat = 25
+
+// setBondSendLowat limita i byte in coda non ancora inviati su una lane del bonding:
+// il socket risulta scrivibile solo quando la coda scende sotto bondNotSent, così una
+// lane lenta non accumula frame che il ricevente dovrebbe poi aspettare
+func setBondSendLowat(c net.Conn) {
+	if tc, ok := c.(*net.TCPConn); ok {
+		if raw, err := tc.SyscallConn(); err == nil {
+			sockoptControl(func(fd int) error {
+				return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, tcpNotSentLowat, bondNotSent)
+			})("", "", raw)
+		}
 	}
-	c, err := dialer.Dial("tcp4", remoteAddr)
-	return c, lb, idx, err
-}
\ No newline at end of file
+}
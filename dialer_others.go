@@ -3,21 +3,44 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"net"
-	"time"
 )
 
-func DialBackend(d *Dispatcher, remoteAddr string) (net.Conn, *Backend, int, error) {
-	lb, idx := d.Next()
-	localAddr, err := net.ResolveTCPAddr("tcp4", lb.Address)
+// Fuori da Linux l'unico modo è il binding all'IP sorgente
+var bindModeChoices []BindMode
+
+var errBindUnsupported = errors.New("SO_BINDTODEVICE is only available on Linux")
+
+// newBackendDialer prepara un dialer con sorgente l'indirizzo IPv4 o IPv6 del backend
+func newBackendDialer(lb *Backend, ipv6 bool) (*net.Dialer, error) {
+	localAddr, err := lb.localAddr(ipv6)
 	if err != nil {
-		return nil, lb, idx, err
+		return nil, err
+	}
+	if m := lb.bindMode(); m == BindDevice || m == BindMark {
+		return nil, fmt.Errorf("backend %s: bind mode %s is only supported on Linux", lb.Name, m)
+	}
+	if lb.Mark != 0 {
+		return nil, fmt.Errorf("backend %s: fwmark is only supported on Linux", lb.Name)
 	}
 	// Windows/Mac non supportano BindToDevice facilmente, ci si affida al binding IP
-	dialer := net.Dialer{
-		LocalAddr: localAddr,
-		Timeout:   10 * time.Second,
+	return &net.Dialer{
+		LocalAddr:       localAddr,
+		Timeout:         backendDialTimeout,
+		KeepAlive:       keepAlivePeriod(lb.keepAlive),
+		KeepAliveConfig: lb.keepAlive,
+	}, nil
+}
+
+func probeBindToDevice() error {
+	return errBindUnsupported
+}
+
+// setBondSendLowat limita il buffer di invio di una lane del bonding (vedi la versione Linux)
+func setBondSendLowat(c net.Conn) {
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetWriteBuffer(2 * bondNotSent)
 	}
-	c, err := dialer.Dial("tcp4", remoteAddr)
-	return c, lb, idx, err
-}
\ No newline at end of file
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Server DNS usati se l'interfaccia non ne dichiara e non ne sono configurati
+var fallbackDNSServers = []string{"1.1.1.1", "8.8.8.8", "2606:4700:4700::1111", "2001:4860:4860::8888"}
+
+const (
+	dnsQueryTimeout = 3 * time.Second
+	dnsMinTTL       = 10 * time.Second
+	dnsMaxTTL       = time.Hour
+	dnsNegativeTTL  = 30 * time.Second
+	dnsCacheMax     = 4096
+)
+
+type dnsLookupKey struct {
+	host  string
+	qtype dnsmessage.Type
+}
+
+type dnsCacheEntry struct {
+	ips     []net.IP
+	err     error // risposta negativa (NXDOMAIN / nessun record)
+	expires time.Time
+}
+
+// BackendResolver risolve i nomi tramite i server DNS del backend, con socket
+// legati all'interfaccia, così le query escono dalla stessa rete della connessione
+type BackendResolver struct {
+	lb         *Backend
+	configured []string
+	log        *slog.Logger
+
+	mu      sync.Mutex
+	servers []string // "ip:53"
+	cache   map[dnsLookupKey]dnsCacheEntry
+}
+
+// newBackendResolver usa i server configurati, altrimenti quelli dell'interfaccia,
+// altrimenti i server pubblici di fallback (sempre interrogati dal backend)
+func newBackendResolver(lb *Backend, configured []string, logger *slog.Logger) *BackendResolver {
+	r := &BackendResolver{lb: lb, configured: configured, log: logger}
+	r.reload()
+	return r
+}
+
+// reload sceglie di nuovo i server e svuota la cache, ad esempio dopo un cambio di indirizzo
+func (r *BackendResolver) reload() {
+	source := "configured"
+	servers := r.reachable(r.configured)
+	if len(servers) == 0 {
+		servers = r.reachable(interfaceDNSServers(r.lb.Interface))
+		source = "interface"
+	}
+	if len(servers) == 0 {
+		servers = r.reachable(fallbackDNSServers)
+		source = "fallback"
+	}
+	r.mu.Lock()
+	r.servers = servers
+	r.cache = make(map[dnsLookupKey]dnsCacheEntry)
+	r.mu.Unlock()
+	r.log.Info("dns servers", "backend", r.lb.Name, "interface", r.lb.Interface, "servers", servers, "source", source)
+}
+
+// serverList restituisce i server correnti
+func (r *BackendResolver) serverList() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.servers
+}
+
+// LookupIP restituisce gli indirizzi di host per le famiglie richieste (AAAA prima di A),
+// interrogando in parallelo; fallisce solo se nessuna delle due risoluzioni riesce
+func (r *BackendResolver) LookupIP(ctx context.Context, host string, want4, want6 bool) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	type result struct {
+		ips []net.IP
+		err error
+	}
+	var v4, v6 result
+	var wg sync.WaitGroup
+	if want4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v4.ips, v4.err = r.lookup(ctx, host, dnsmessage.TypeA)
+		}()
+	}
+	if want6 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v6.ips, v6.err = r.lookup(ctx, host, dnsmessage.TypeAAAA)
+		}()
+	}
+	wg.Wait()
+
+	ips := append(v6.ips, v4.ips...)
+	if len(ips) > 0 {
+		return ips, nil
+	}
+	if v4.err != nil {
+		return nil, v4.err
+	}
+	if v6.err != nil {
+		return nil, v6.err
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// lookup risolve un solo tipo di record, dalla cache se ancora valido
+func (r *BackendResolver) lookup(ctx context.Context, host string, qtype dnsmessage.Type) ([]net.IP, error) {
+	name, err := dnsmessage.NewName(dnsFQDN(host))
+	if err != nil {
+		return nil, &net.DNSError{Err: "invalid name", Name: host, IsNotFound: true}
+	}
+	key := dnsLookupKey{host, qtype}
+
+	r.mu.Lock()
+	e, ok := r.cache[key]
+	r.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.ips, e.err
+	}
+
+	ips, ttl, err := r.query(ctx, name, qtype)
+	var dnsErr *net.DNSError
+	if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		return nil, err // errori temporanei: niente cache
+	}
+	if err != nil {
+		ttl = dnsNegativeTTL
+	}
+	r.mu.Lock()
+	if len(r.cache) >= dnsCacheMax {
+		r.pruneLocked()
+	}
+	r.cache[key] = dnsCacheEntry{ips: ips, err: err, expires: time.Now().Add(ttl)}
+	r.mu.Unlock()
+	return ips, err
+}
+
+// reachable normalizza i server in "ip:porta" tenendo solo le famiglie
+// per cui il backend ha un indirizzo sorgente
+func (r *BackendResolver) reachable(servers []string) []string {
+	v4, v6 := r.lb.Addrs()
+	var out []string
+	for _, s := range servers {
+		s = strings.TrimSpace(s)
+		if _, _, err := net.SplitHostPort(s); err != nil {
+			s = net.JoinHostPort(s, "53")
+		}
+		host, _, _ := net.SplitHostPort(s)
+		ip := net.ParseIP(host)
+		if ip == nil {
+			continue
+		}
+		if (ip.To4() != nil && v4 != nil) || (ip.To4() == nil && v6 != nil) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// pruneLocked elimina le voci scadute e, se non basta, svuota la cache
+func (r *BackendResolver) pruneLocked() {
+	now := time.Now()
+	for k, e := range r.cache {
+		if now.After(e.expires) {
+			delete(r.cache, k)
+		}
+	}
+	if len(r.cache) >= dnsCacheMax {
+		clear(r.cache)
+	}
+}
+
+// query interroga i server del backend e interpreta la risposta come lookup di indirizzi
+func (r *BackendResolver) query(ctx context.Context, name dnsmessage.Name, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	host := strings.TrimSuffix(name.String(), ".")
+	q := dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}
+	resp, server, err := r.forward(ctx, q)
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: host, IsTemporary: true}
+	}
+	if resp.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, Server: server, IsNotFound: true}
+	}
+	ips, ttl := answerIPs(resp, qtype)
+	if len(ips) == 0 {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, Server: server, IsNotFound: true}
+	}
+	return ips, ttl, nil
+}
+
+// forward interroga i server in ordine e restituisce la prima risposta definitiva
+// (successo o NXDOMAIN) con il server che l'ha data
+func (r *BackendResolver) forward(ctx context.Context, q dnsmessage.Question) (*dnsmessage.Message, string, error) {
+	var lastErr error
+	for _, server := range r.serverList() {
+		resp, err := r.ask(ctx, server, q)
+		if err == nil && resp.RCode != dnsmessage.RCodeSuccess && resp.RCode != dnsmessage.RCodeNameError {
+			err = fmt.Errorf("server %s: %s", server, resp.RCode)
+		}
+		if err != nil {
+			lastErr = err
+			if debugEnabled(r.log) {
+				r.log.Debug("dns query failed", "backend", r.lb.Name, "server", server, "name", q.Name.String(), "error", err)
+			}
+			continue
+		}
+		return resp, server, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("backend %s: no reachable dns server", r.lb.Name)
+	}
+	return nil, "", lastErr
+}
+
+// ask invia una singola domanda a server via UDP dal backend, ripetendola
+// via TCP se la risposta è troncata
+func (r *BackendResolver) ask(ctx context.Context, server string, q dnsmessage.Question) (*dnsmessage.Message, error) {
+	ctx, cancel := context.WithTimeout(ctx, dnsQueryTimeout)
+	defer cancel()
+
+	id := uint16(rand.Uint32())
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{q},
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := r.exchange(ctx, "udp", server, packed)
+	if err == nil && resp.Truncated {
+		resp, err = r.exchange(ctx, "tcp", server, packed)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.ID != id || len(resp.Questions) != 1 || resp.Questions[0] != q {
+		return nil, errors.New("mismatched dns response")
+	}
+	return resp, nil
+}
+
+func (r *BackendResolver) exchange(ctx context.Context, network, server string, packed []byte) (*dnsmessage.Message, error) {
+	raw, err := r.roundTrip(ctx, network, server, packed)
+	if err != nil {
+		return nil, err
+	}
+	var resp dnsmessage.Message
+	if err := resp.Unpack(raw); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// roundTrip apre un socket legato al backend verso server e scambia un messaggio;
+// network è "udp" o "tcp", la famiglia dipende dall'indirizzo del server
+func (r *BackendResolver) roundTrip(ctx context.Context, network, server string, packed []byte) ([]byte, error) {
+	host, _, _ := net.SplitHostPort(server)
+	ipv6 := net.ParseIP(host).To4() == nil
+	d, err := newBackendDialer(r.lb, ipv6)
+	if err != nil {
+		return nil, err
+	}
+	if network == "udp" {
+		d.LocalAddr = &net.UDPAddr{IP: d.LocalAddr.(*net.TCPAddr).IP}
+	}
+	c, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+
+	if network == "udp" {
+		if _, err := c.Write(packed); err != nil {
+			return nil, err
+		}
+		// Le risposte con un altro ID (in ritardo o contraffatte) si scartano e si
+		// continua ad attendere fino alla scadenza
+		buf := make([]byte, 4096)
+		for {
+			n, err := c.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			if n >= 2 && buf[0] == packed[0] && buf[1] == packed[1] {
+				return buf[:n], nil
+			}
+		}
+	}
+
+	// TCP: messaggio preceduto dalla lunghezza (RFC 1035 4.2.2)
+	out := make([]byte, 2+len(packed))
+	binary.BigEndian.PutUint16(out, uint16(len(packed)))
+	copy(out[2:], packed)
+	if _, err := c.Write(out); err != nil {
+		return nil, err
+	}
+	var l [2]byte
+	if _, err := io.ReadFull(c, l[:]); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// answerIPs estrae gli indirizzi del tipo richiesto e il TTL minimo, limitato a [dnsMinTTL, dnsMaxTTL]
+func answerIPs(m *dnsmessage.Message, qtype dnsmessage.Type) ([]net.IP, time.Duration) {
+	var ips []net.IP
+	ttl := dnsMaxTTL
+	for _, a := range m.Answers {
+		var ip net.IP
+		switch body := a.Body.(type) {
+		case *dnsmessage.AResource:
+			if qtype == dnsmessage.TypeA {
+				ip = net.IP(body.A[:])
+			}
+		case *dnsmessage.AAAAResource:
+			if qtype == dnsmessage.TypeAAAA {
+				ip = net.IP(body.AAAA[:])
+			}
+		}
+		if ip == nil {
+			continue
+		}
+		ips = append(ips, ip)
+		if t := time.Duration(a.Header.TTL) * time.Second; t < ttl {
+			ttl = t
+		}
+	}
+	return ips, max(ttl, dnsMinTTL)
+}
+
+// dnsServerIPs tiene gli IPv4 non di loopback e gli IPv6 globali
+// (gli stub locali come 127.0.0.53 non sarebbero raggiungibili dal backend)
+func dnsServerIPs(fields []string) []string {
+	var servers []string
+	for _, s := range fields {
+		ip := net.ParseIP(s)
+		if ip == nil || ip.IsLoopback() || (ip.To4() == nil && !globalIPv6(ip)) {
+			continue
+		}
+		servers = append(servers, ip.String())
+	}
+	return servers
+}
+
+func dnsFQDN(host string) string {
+	if len(host) > 0 && host[len(host)-1] == '.' {
+		return host
+	}
+	return host + "."
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var dnsForwarder DNSForwarder
+
+const (
+	dnsUDPMaxSize     = 512 // risposte UDP senza EDNS (RFC 1035 4.2.1)
+	dnsTCPIdle        = 10 * time.Second
+	dnsForwardTimeout = 5 * time.Second
+	dnsUDPInflight    = 256 // query UDP servite in parallelo, oltre si scartano
+)
+
+type dnsCacheKey struct {
+	name  string // minuscolo
+	qtype dnsmessage.Type
+	class dnsmessage.Class
+}
+
+type dnsCachedResponse struct {
+	msg     *dnsmessage.Message
+	stored  time.Time
+	expires time.Time
+}
+
+// DNSForwarder è un server DNS locale (UDP e TCP) che inoltra le query sui backend
+// del proxy, mettendo in gara più interfacce e tenendo una cache con i TTL
+type DNSForwarder struct {
+	mu      sync.Mutex
+	running bool
+	udp     net.PacketConn
+	tcp     net.Listener
+	stop    chan struct{}         // chiuso da Stop: le query ancora in arrivo non si inoltrano
+	conns   map[net.Conn]struct{} // connessioni TCP aperte, chiuse da Stop
+	proxy   *ProxyServer
+	log     *slog.Logger
+	race    int // backend interrogati in parallelo per ogni query
+
+	cacheMu sync.Mutex
+	cache   map[dnsCacheKey]dnsCachedResponse
+}
+
+// Start ascolta su addr (UDP e TCP) e inoltra tramite i backend del proxy in esecuzione
+func (f *DNSForwarder) Start(addr string, race int, p *ProxyServer, logger *slog.Logger) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.running {
+		return fmt.Errorf("dns forwarder already running")
+	}
+
+	udp, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		udp.Close()
+		return err
+	}
+
+	f.udp, f.tcp = udp, tcp
+	f.stop = make(chan struct{})
+	f.conns = make(map[net.Conn]struct{})
+	f.proxy = p
+	f.log = logger.With("subsystem", subsysDNS)
+	f.race = max(race, 1)
+	f.cache = make(map[dnsCacheKey]dnsCachedResponse)
+	f.running = true
+
+	go f.serveUDP(udp, f.stop)
+	go f.serveTCP(tcp, f.stop)
+	f.log.Info("dns forwarder started", "listen", udp.LocalAddr().String(), "race", f.race)
+	return nil
+}
+
+func (f *DNSForwarder) Stop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.running {
+		return
+	}
+	f.running = false
+	close(f.stop)
+	f.udp.Close()
+	f.tcp.Close()
+	for c := range f.conns {
+		c.Close()
+	}
+	f.conns = nil
+	f.log.Info("dns forwarder stopped")
+}
+
+// stopped dice se il forwarder che ha ricevuto la query è stato fermato nel frattempo
+func stopped(stop chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (f *DNSForwarder) serveUDP(pc net.PacketConn, stop chan struct{}) {
+	buf := make([]byte, 4096)
+	sem := make(chan struct{}, dnsUDPInflight)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				f.log.Error("dns udp read failed", "error", err)
+			}
+			return
+		}
+		// Con i backend lenti le query si accumulano: oltre il limite si scartano e
+		// il client ripete la richiesta
+		select {
+		case sem <- struct{}{}:
+		default:
+			if debugEnabled(f.log) {
+				f.log.Debug("dns query dropped, too many in flight", "client", addr.String())
+			}
+			continue
+		}
+		req := append([]byte(nil), buf[:n]...)
+		go func() {
+			defer func() { <-sem }()
+			if stopped(stop) {
+				return
+			}
+			if resp := f.handle(req, true); resp != nil {
+				pc.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+func (f *DNSForwarder) serveTCP(l net.Listener, stop chan struct{}) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				f.log.Error("dns tcp accept failed", "error", err)
+			}
+			return
+		}
+		f.mu.Lock()
+		if stopped(stop) {
+			// Stop è arrivato tra l'Accept e la registrazione
+			f.mu.Unlock()
+			c.Close()
+			return
+		}
+		f.conns[c] = struct{}{}
+		f.mu.Unlock()
+		go f.serveTCPConn(c, stop)
+	}
+}
+
+// serveTCPConn gestisce più query sulla stessa connessione, ognuna preceduta dalla lunghezza
+func (f *DNSForwarder) serveTCPConn(c net.Conn, stop chan struct{}) {
+	defer func() {
+		f.mu.Lock()
+		delete(f.conns, c)
+		f.mu.Unlock()
+		c.Close()
+	}()
+	var l [2]byte
+	for {
+		c.SetDeadline(time.Now().Add(dnsTCPIdle))
+		if _, err := io.ReadFull(c, l[:]); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint16(l[:]))
+		if _, err := io.ReadFull(c, req); err != nil {
+			return
+		}
+		if stopped(stop) {
+			return
+		}
+		resp := f.handle(req, false)
+		if resp == nil {
+			return
+		}
+		out := make([]byte, 2+len(resp))
+		binary.BigEndian.PutUint16(out, uint16(len(resp)))
+		copy(out[2:], resp)
+		if _, err := c.Write(out); err != nil {
+			return
+		}
+	}
+}
+
+// handle risponde a una query impacchettata; nil se il messaggio è illeggibile
+func (f *DNSForwarder) handle(raw []byte, udp bool) []byte {
+	var req dnsmessage.Message
+	if err := req.Unpack(raw); err != nil || req.Response {
+		return nil
+	}
+	resp := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 req.ID,
+			Response:           true,
+			OpCode:             req.OpCode,
+			RecursionDesired:   req.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: req.Questions,
+	}
+	switch {
+	case req.OpCode != 0:
+		resp.RCode = dnsmessage.RCodeNotImplemented
+	case len(req.Questions) != 1:
+		resp.RCode = dnsmessage.RCodeFormatError
+	default:
+		up, err := f.resolve(req.Questions[0])
+		if err != nil {
+			if debugEnabled(f.log) {
+				f.log.Debug("dns forward failed", "name", req.Questions[0].Name.String(), "error", err)
+			}
+			resp.RCode = dnsmessage.RCodeServerFailure
+		} else {
+			resp.RCode = up.RCode
+			resp.Answers = up.Answers
+			resp.Authorities = up.Authorities
+		}
+	}
+
+	out, err := resp.Pack()
+	if err != nil {
+		return nil
+	}
+	if udp && len(out) > dnsUDPMaxSize {
+		// Il client ripeterà la query via TCP
+		resp.Truncated = true
+		resp.Answers, resp.Authorities = nil, nil
+		out, _ = resp.Pack()
+	}
+	return out
+}
+
+// resolve risponde dalla cache o mette in gara i backend scelti dal dispatcher
+func (f *DNSForwarder) resolve(q dnsmessage.Question) (*dnsmessage.Message, error) {
+	key := dnsCacheKey{strings.ToLower(q.Name.String()), q.Type, q.Class}
+	if m := f.cached(key); m != nil {
+		return m, nil
+	}
+
+	backends := f.proxy.dnsBackends(f.race)
+	if len(backends) == 0 {
+		return nil, errors.New("proxy not running or no backends")
+	}
+
+	type result struct {
+		msg *dnsmessage.Message
+		lb  *Backend
+		err error
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dnsForwardTimeout)
+	defer cancel()
+	results := make(chan result, len(backends))
+	for _, lb := range backends {
+		go func(lb *Backend) {
+			m, _, err := lb.Resolver.forward(ctx, q)
+			results <- result{m, lb, err}
+		}(lb)
+	}
+
+	var lastErr error
+	for range backends {
+		r := <-results
+		if r.err != nil {
+			lastErr = r.err
+			continue
+		}
+		if debugEnabled(f.log) {
+			f.log.Debug("dns forward", "name", q.Name.String(), "type", q.Type.String(), "backend", r.lb.Name, "rcode", r.msg.RCode.String())
+		}
+		f.store(key, r.msg)
+		return r.msg, nil
+	}
+	return nil, lastErr
+}
+
+// cached restituisce una copia della risposta in cache con i TTL ridotti del tempo trascorso
+func (f *DNSForwarder) cached(key dnsCacheKey) *dnsmessage.Message {
+	f.cacheMu.Lock()
+	e, ok := f.cache[key]
+	f.cacheMu.Unlock()
+	now := time.Now()
+	if !ok || now.After(e.expires) {
+		return nil
+	}
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	age := func(rs []dnsmessage.Resource) []dnsmessage.Resource {
+		out := make([]dnsmessage.Resource, len(rs))
+		for i, r := range rs {
+			out[i] = r
+			out[i].Header.TTL = r.Header.TTL - min(elapsed, r.Header.TTL)
+		}
+		return out
+	}
+	m := *e.msg
+	m.Answers = age(e.msg.Answers)
+	m.Authorities = age(e.msg.Authorities)
+	return &m
+}
+
+// store mette in cache la risposta per il TTL minimo dei suoi record; le risposte
+// negative seguono il SOA in authority (RFC 2308) e senza SOA non si tengono
+func (f *DNSForwarder) store(key dnsCacheKey, m *dnsmessage.Message) {
+	ttl := dnsMaxTTL
+	if m.RCode == dnsmessage.RCodeNameError || len(m.Answers) == 0 {
+		neg, ok := negativeTTL(m)
+		if !ok {
+			return
+		}
+		ttl = min(ttl, neg)
+		// Dalla cache il SOA non deve annunciare una durata maggiore della risposta
+		auth := append([]dnsmessage.Resource(nil), m.Authorities...)
+		for i := range auth {
+			if _, ok := auth[i].Body.(*dnsmessage.SOAResource); ok {
+				auth[i].Header.TTL = uint32(ttl / time.Second)
+			}
+		}
+		cp := *m
+		cp.Authorities = auth
+		m = &cp
+	} else {
+		for _, rs := range [][]dnsmessage.Resource{m.Answers, m.Authorities} {
+			for _, r := range rs {
+				ttl = min(ttl, time.Duration(r.Header.TTL)*time.Second)
+			}
+		}
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	now := time.Now()
+	f.cacheMu.Lock()
+	defer f.cacheMu.Unlock()
+	if len(f.cache) >= dnsCacheMax {
+		for k, e := range f.cache {
+			if now.After(e.expires) {
+				delete(f.cache, k)
+			}
+		}
+		if len(f.cache) >= dnsCacheMax {
+			clear(f.cache)
+		}
+	}
+	f.cache[key] = dnsCachedResponse{msg: m, stored: now, expires: now.Add(ttl)}
+}
+
+// negativeTTL è la durata di una risposta negativa (NXDOMAIN o nessun record): il minimo
+// tra il TTL del SOA in authority e il suo campo MINIMUM (RFC 2308 §5); false senza SOA
+func negativeTTL(m *dnsmessage.Message) (time.Duration, bool) {
+	for _, r := range m.Authorities {
+		if soa, ok := r.Body.(*dnsmessage.SOAResource); ok {
+			return time.Duration(min(r.Header.TTL, soa.MinTTL)) * time.Second, true
+		}
+	}
+	return 0, false
+}
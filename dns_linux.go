@@ -0,0 +1,27 @@
+//go:build linux
+
+package main
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// interfaceDNSServers legge i server DNS del link da systemd-resolved. /etc/resolv.conf
+// non viene usato: i suoi server sono quelli globali, non dell'interfaccia, e
+// potrebbero essere raggiungibili solo da un'altra rete.
+func interfaceDNSServers(iface string) []string {
+	if iface == "" {
+		return nil
+	}
+	out, err := exec.Command("resolvectl", "dns", iface).Output()
+	if err != nil {
+		return nil
+	}
+	// Formato: "Link 3 (wlan0): 192.168.43.1 fe80::1%wlan0"
+	_, list, ok := strings.Cut(string(out), "):")
+	if !ok {
+		return nil
+	}
+	return dnsServerIPs(strings.Fields(list))
+}
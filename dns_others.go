@@ -0,0 +1,8 @@
+//go:build !linux && !windows
+
+package main
+
+// interfaceDNSServers non è implementata: si usano i server configurati o di fallback
+func interfaceDNSServers(iface string) []string {
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNSServer risponde via UDP su loopback con i messaggi restituiti da reply
+func fakeDNSServer(t *testing.T, reply func(q dnsmessage.Message) []dnsmessage.Message) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var q dnsmessage.Message
+			if q.Unpack(buf[:n]) != nil {
+				continue
+			}
+			for _, m := range reply(q) {
+				packed, _ := m.Pack()
+				pc.WriteTo(packed, addr)
+			}
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+// aReply risponde a q con un record A e il TTL indicato
+func aReply(q dnsmessage.Message, ip [4]byte, ttl uint32) dnsmessage.Message {
+	return dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: q.ID, Response: true, RecursionAvailable: true},
+		Questions: q.Questions,
+		Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: q.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+			Body:   &dnsmessage.AResource{A: ip},
+		}},
+	}
+}
+
+// loopbackResolver è un resolver su un backend legato a 127.0.0.1
+func loopbackResolver(t *testing.T, server string) *BackendResolver {
+	t.Helper()
+	lb := parseLoadBalancers([]string{"127.0.0.1"}, false)[0]
+	r := &BackendResolver{lb: lb, log: slog.New(slog.DiscardHandler), cache: make(map[dnsLookupKey]dnsCacheEntry)}
+	r.servers = []string{server}
+	return r
+}
+
+func TestResolverIgnoresMismatchedID(t *testing.T) {
+	server := fakeDNSServer(t, func(q dnsmessage.Message) []dnsmessage.Message {
+		stale := aReply(q, [4]byte{10, 6, 6, 6}, 60)
+		stale.ID++
+		return []dnsmessage.Message{stale, aReply(q, [4]byte{192, 0, 2, 1}, 60)}
+	})
+	r := loopbackResolver(t, server)
+	ips, err := r.LookupIP(context.Background(), "example.com", true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("LookupIP = %v, want the answer with the matching ID", ips)
+	}
+}
+
+func dnsName(s string) dnsmessage.Name {
+	return dnsmessage.MustNewName(s)
+}
+
+func aRecord(ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsName("example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+	}
+}
+
+func soaRecord(ttl, minimum uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsName("example.com."), Type: dnsmessage.TypeSOA, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body: &dnsmessage.SOAResource{
+			NS: dnsName("ns.example.com."), MBox: dnsName("hostmaster.example.com."),
+			Serial: 1, Refresh: 7200, Retry: 3600, Expire: 1209600, MinTTL: minimum,
+		},
+	}
+}
+
+func TestForwarderCacheTTL(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  dnsmessage.Message
+		want time.Duration // 0 = non in cache
+	}{
+		{"minimum answer ttl", dnsmessage.Message{Answers: []dnsmessage.Resource{aRecord(300), aRecord(60)}}, time.Minute},
+		{"capped", dnsmessage.Message{Answers: []dnsmessage.Resource{aRecord(86400)}}, dnsMaxTTL},
+		{"zero ttl", dnsmessage.Message{Answers: []dnsmessage.Resource{aRecord(0)}}, 0},
+		{"nxdomain soa minimum", dnsmessage.Message{
+			Header:      dnsmessage.Header{RCode: dnsmessage.RCodeNameError},
+			Authorities: []dnsmessage.Resource{soaRecord(3600, 300)},
+		}, 5 * time.Minute},
+		{"nodata soa ttl", dnsmessage.Message{Authorities: []dnsmessage.Resource{soaRecord(100, 900)}}, 100 * time.Second},
+		{"nxdomain without soa", dnsmessage.Message{Header: dnsmessage.Header{RCode: dnsmessage.RCodeNameError}}, 0},
+	}
+	for _, tt := range tests {
+		f := &DNSForwarder{cache: make(map[dnsCacheKey]dnsCachedResponse)}
+		key := dnsCacheKey{"example.com.", dnsmessage.TypeA, dnsmessage.ClassINET}
+		f.store(key, &tt.msg)
+		e, ok := f.cache[key]
+		if tt.want == 0 {
+			if ok {
+				t.Errorf("%s: cached for %v, want not cached", tt.name, e.expires.Sub(e.stored))
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%s: not cached", tt.name)
+			continue
+		}
+		if got := e.expires.Sub(e.stored); got != tt.want {
+			t.Errorf("%s: cached for %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestForwarderCacheAging(t *testing.T) {
+	f := &DNSForwarder{cache: make(map[dnsCacheKey]dnsCachedResponse)}
+	key := dnsCacheKey{"example.com.", dnsmessage.TypeA, dnsmessage.ClassINET}
+	neg := &dnsmessage.Message{
+		Header:      dnsmessage.Header{RCode: dnsmessage.RCodeNameError},
+		Authorities: []dnsmessage.Resource{soaRecord(3600, 300)},
+	}
+	f.store(key, neg)
+	if neg.Authorities[0].Header.TTL != 3600 {
+		t.Error("store modified the caller's message")
+	}
+
+	// Dieci secondi dopo il SOA annuncia il TTL negativo residuo
+	e := f.cache[key]
+	e.stored = e.stored.Add(-10 * time.Second)
+	f.cache[key] = e
+	m := f.cached(key)
+	if m == nil {
+		t.Fatal("entry not returned")
+	}
+	if ttl := m.Authorities[0].Header.TTL; ttl != 290 {
+		t.Errorf("aged SOA ttl = %d, want 290", ttl)
+	}
+
+	e.expires = time.Now().Add(-time.Second)
+	f.cache[key] = e
+	if f.cached(key) != nil {
+		t.Error("expired entry returned")
+	}
+}
+
+// tcpQuery invia una query A con la lunghezza in testa e legge la risposta
+func tcpQuery(c net.Conn, id uint16) (dnsmessage.Message, error) {
+	q := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsName("example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+	packed, _ := q.Pack()
+	out := binary.BigEndian.AppendUint16(nil, uint16(len(packed)))
+	if _, err := c.Write(append(out, packed...)); err != nil {
+		return dnsmessage.Message{}, err
+	}
+	var l [2]byte
+	if _, err := io.ReadFull(c, l[:]); err != nil {
+		return dnsmessage.Message{}, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(c, resp); err != nil {
+		return dnsmessage.Message{}, err
+	}
+	var m dnsmessage.Message
+	return m, m.Unpack(resp)
+}
+
+func TestForwarderStopClosesTCP(t *testing.T) {
+	var f DNSForwarder
+	if err := f.Start("127.0.0.1:0", 1, &ProxyServer{}, slog.New(slog.DiscardHandler)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(f.Stop)
+	c, err := net.Dial("tcp", f.tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Proxy fermo: la risposta è SERVFAIL, ma la connessione resta aperta per altre query
+	m, err := tcpQuery(c, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ID != 1 || m.RCode != dnsmessage.RCodeServerFailure {
+		t.Errorf("reply id %d rcode %v, want 1 SERVFAIL", m.ID, m.RCode)
+	}
+
+	f.Stop()
+	c.SetDeadline(time.Now().Add(time.Second))
+	if m, err := tcpQuery(c, 2); err == nil {
+		t.Errorf("query answered after Stop (rcode %v)", m.RCode)
+	} else if errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error("connection still open after Stop")
+	}
+}
@@ -0,0 +1,24 @@
+//go:build windows
+
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// interfaceDNSServers interroga PowerShell per i server DNS dell'interfaccia
+func interfaceDNSServers(iface string) []string {
+	if iface == "" {
+		return nil
+	}
+	cmd := exec.Command("powershell", "-NoProfile", "-Command",
+		"(Get-DnsClientServerAddress -InterfaceAlias '"+strings.ReplaceAll(iface, "'", "''")+"').ServerAddresses")
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	out, err := cmd.Output()
+	if err != nil {
+		return nil
+	}
+	return dnsServerIPs(strings.Fields(string(out)))
+}
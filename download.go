@@ -0,0 +1,573 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	downloadMinSplit  = 256 << 10 // un segmento con meno byte rimasti non viene diviso
+	downloadRetries   = 5         // tentativi consecutivi falliti di un segmento prima di arrendersi
+	downloadRetryWait = 2 * time.Second
+	downloadSaveEvery = 2 * time.Second // salvataggio dello stato per la ripresa
+)
+
+// dlState è il file di stato accanto al download parziale (<output>.dlstate): basta
+// a riprendere da dove si era arrivati se URL, dimensione e versione non sono cambiati
+type dlState struct {
+	URL          string       `json:"url"`
+	Size         int64        `json:"size"`
+	ETag         string       `json:"etag,omitempty"`
+	LastModified string       `json:"last_modified,omitempty"`
+	Segments     []*dlSegment `json:"segments"`
+}
+
+// dlSegment è l'intervallo [Pos, End) ancora da scaricare di una parte del file
+type dlSegment struct {
+	Pos int64 `json:"pos"`
+	End int64 `json:"end"`
+
+	busy    bool      // assegnato a un worker
+	started time.Time // per la velocità del segmento, usata nel ribilanciamento
+	fetched int64
+}
+
+// downloader scarica un file a segmenti in parallelo: ogni segmento è una richiesta
+// Range su un backend scelto dal Dispatcher; un worker che finisce prende la metà del
+// segmento che finirebbe per ultimo, così i collegamenti veloci tolgono lavoro a quelli lenti
+type downloader struct {
+	url      string
+	out      *os.File
+	d        *Dispatcher
+	clients  map[*Backend]*http.Client
+	ifRange  string
+	mu       sync.Mutex
+	state    *dlState
+	done     atomic.Int64
+	perLink  map[*Backend]*atomic.Int64
+	statPath string
+}
+
+// runDownload è il sottocomando "download"
+func runDownload(args []string) error {
+	fs := flag.NewFlagSet("download", flag.ContinueOnError)
+	output := fs.String("o", "", "output file (default: the last element of the URL path)")
+	conns := fs.Int("connections", 16, "parallel connections, spread over the backends")
+	backends := fs.String("backends", "", "comma-separated backends as for the proxy, e.g. usb0,wlan0@2,socks5://host:1080 (default: all usable interfaces)")
+	sum := fs.String("sha256", "", "expected SHA-256 of the file, checked after the download")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s download [flags] URL\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return flag.ErrHelp
+	}
+	rawURL := fs.Arg(0)
+	if *output == "" {
+		*output = path.Base(strings.SplitN(rawURL, "?", 2)[0])
+		if *output == "" || *output == "/" || *output == "." {
+			*output = "download.bin"
+		}
+	}
+
+	var list []string
+	if *backends != "" {
+		list = strings.Split(*backends, ",")
+	} else {
+		for _, nic := range getValidInterfaces() {
+			list = append(list, nic.name)
+		}
+	}
+	var s ProxyServer
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
+	var lbs []*Backend
+	for _, arg := range list {
+		if arg = strings.TrimSpace(arg); arg == "" {
+			continue
+		}
+		name, ratio := splitWeight(arg)
+		b := s.TestBackend(name, logger)
+		if b == nil || b.Down() {
+			fmt.Fprintf(os.Stderr, "skipping %s: not a usable interface or upstream proxy\n", name)
+			continue
+		}
+		b.ContentionRatio = ratio
+		lbs = append(lbs, b)
+	}
+	if len(lbs) == 0 {
+		return errors.New("no usable backend")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	dl := &downloader{
+		url:      rawURL,
+		d:        NewDispatcher(lbs),
+		clients:  make(map[*Backend]*http.Client),
+		perLink:  make(map[*Backend]*atomic.Int64),
+		statPath: *output + ".dlstate",
+	}
+	for _, b := range lbs {
+		dl.clients[b] = &http.Client{Transport: backendTransport(b)}
+		dl.perLink[b] = new(atomic.Int64)
+	}
+	fmt.Printf("downloading %s to %s over %d backends\n", rawURL, *output, len(lbs))
+	if err := dl.run(ctx, *output, max(*conns, 1)); err != nil {
+		return err
+	}
+	return verifyDownload(*output, dl.state.Size, *sum)
+}
+
+// run prepara il file parziale (nuovo o ripreso), scarica e al termine lo rinomina in output
+func (dl *downloader) run(ctx context.Context, output string, conns int) error {
+	probe, err := dl.probe(ctx)
+	if err != nil {
+		return err
+	}
+	part := output + ".part"
+	if st, err := loadDownloadState(dl.statPath); err == nil && st.matches(probe) && fileExists(part) {
+		dl.state = st
+		fmt.Printf("resuming: %d of %d bytes already downloaded\n", st.downloaded(), st.Size)
+	} else {
+		dl.state = probe
+		n := int64(conns)
+		if probe.Size < 0 {
+			n = 1 // dimensione ignota o niente Range: un solo flusso
+		}
+		step := max(probe.Size/n, 1)
+		for start := int64(0); start < probe.Size || len(probe.Segments) == 0; start += step {
+			end := min(start+step, probe.Size)
+			if probe.Size-end < step/2 || probe.Size < 0 {
+				end = probe.Size // l'avanzo va all'ultimo segmento
+			}
+			probe.Segments = append(probe.Segments, &dlSegment{Pos: start, End: end})
+			if end == probe.Size {
+				break
+			}
+		}
+		os.Remove(part)
+	}
+	dl.done.Store(dl.state.downloaded())
+
+	dl.out, err = os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer dl.out.Close()
+	if dl.state.Size >= 0 {
+		if err := dl.out.Truncate(dl.state.Size); err != nil {
+			return err
+		}
+	}
+
+	err = dl.fetch(ctx, conns)
+	if serr := dl.save(); err == nil && dl.state.Size >= 0 {
+		err = serr
+	}
+	if err != nil {
+		if ctx.Err() != nil && dl.state.Size >= 0 {
+			return fmt.Errorf("interrupted at %d of %d bytes; run the same command again to resume", dl.done.Load(), dl.state.Size)
+		}
+		return err
+	}
+	if dl.state.Size < 0 {
+		dl.state.Size = dl.done.Load()
+	}
+	if err := dl.out.Close(); err != nil {
+		return err
+	}
+	os.Remove(dl.statPath)
+	return os.Rename(part, output)
+}
+
+// probe chiede il primo byte per sapere dimensione, versione e supporto di Range
+func (dl *downloader) probe(ctx context.Context) (*dlState, error) {
+	lb, _ := dl.d.Next()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, dl.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := dl.clients[lb].Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("backend %s: %w", lb.Name, err)
+	}
+	resp.Body.Close()
+
+	st := &dlState{URL: dl.url, Size: -1, ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		cr := resp.Header.Get("Content-Range")
+		if i := strings.LastIndexByte(cr, '/'); i >= 0 {
+			st.Size, _ = strconv.ParseInt(cr[i+1:], 10, 64)
+		}
+		if st.Size <= 0 {
+			return nil, fmt.Errorf("invalid Content-Range %q", cr)
+		}
+	case http.StatusOK:
+		fmt.Println("server does not support ranges: downloading over a single connection, without resume")
+	default:
+		return nil, fmt.Errorf("server replied %s", resp.Status)
+	}
+	// If-Range fa rispondere 200 invece di 206 se il file è cambiato nel frattempo
+	switch {
+	case st.ETag != "" && !strings.HasPrefix(st.ETag, "W/"):
+		dl.ifRange = st.ETag
+	case st.LastModified != "":
+		dl.ifRange = st.LastModified
+	}
+	return st, nil
+}
+
+// fetch avvia conns worker e attende che tutti i segmenti siano completi
+func (dl *downloader) fetch(ctx context.Context, conns int) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var wg sync.WaitGroup
+	for range conns {
+		wg.Add(1)
+		// Ogni worker resta sul suo backend, così quelli dei collegamenti veloci finiscono
+		// prima e prendono lavoro agli altri; i pesi decidono quanti worker per backend
+		lb, _ := dl.d.Next()
+		go func() {
+			defer wg.Done()
+			for {
+				seg := dl.nextSegment()
+				if seg == nil {
+					return
+				}
+				if err := dl.fetchSegment(ctx, seg, &lb); err != nil {
+					cancel(err)
+					return
+				}
+			}
+		}()
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	lastSave := time.Now()
+	prev := dl.snapshotLinks()
+	for {
+		select {
+		case <-finished:
+			dl.progress(prev, time.Second)
+			fmt.Println()
+			return context.Cause(ctx)
+		case <-tick.C:
+			prev = dl.progress(prev, time.Second)
+			if time.Since(lastSave) >= downloadSaveEvery {
+				dl.save()
+				lastSave = time.Now()
+			}
+		}
+	}
+}
+
+// nextSegment restituisce un segmento libero o, se non ce ne sono, divide a metà quello
+// che in base alla sua velocità finirebbe per ultimo; nil quando non resta lavoro
+func (dl *downloader) nextSegment() *dlSegment {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	// Un segmento appena partito non ha ancora una velocità: si sceglie tra quelli
+	// avviati da almeno un secondo, altrimenti il più lungo
+	var slowest, largest *dlSegment
+	var slowestETA float64
+	for _, seg := range dl.state.Segments {
+		left := seg.End - seg.Pos
+		if seg.End >= 0 && left <= 0 {
+			continue
+		}
+		if !seg.busy {
+			seg.busy, seg.started, seg.fetched = true, time.Now(), 0
+			return seg
+		}
+		if seg.End < 0 || left < 2*downloadMinSplit {
+			continue
+		}
+		if largest == nil || left > largest.End-largest.Pos {
+			largest = seg
+		}
+		age := time.Since(seg.started).Seconds()
+		if age < 1 {
+			continue
+		}
+		eta := float64(left) / max(float64(seg.fetched)/age, 1)
+		if slowest == nil || eta > slowestETA {
+			slowest, slowestETA = seg, eta
+		}
+	}
+	if slowest == nil {
+		slowest = largest
+	}
+	if slowest == nil {
+		return nil
+	}
+	mid := slowest.Pos + (slowest.End-slowest.Pos)/2
+	seg := &dlSegment{Pos: mid, End: slowest.End, busy: true, started: time.Now()}
+	slowest.End = mid
+	dl.state.Segments = append(dl.state.Segments, seg)
+	return seg
+}
+
+// fetchSegment scarica il segmento sul backend del worker, passando a un altro backend
+// sano se la richiesta fallisce; il segmento può accorciarsi mentre è in corso
+func (dl *downloader) fetchSegment(ctx context.Context, seg *dlSegment, lb **Backend) error {
+	defer func() {
+		dl.mu.Lock()
+		seg.busy = false
+		dl.mu.Unlock()
+	}()
+	fails := 0
+	for {
+		dl.mu.Lock()
+		pos, end := seg.Pos, seg.End
+		dl.mu.Unlock()
+		if end >= 0 && pos >= end {
+			return nil
+		}
+		err := dl.fetchRange(ctx, *lb, seg)
+		if err == nil {
+			fails = 0
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, errDownloadChanged) {
+			return err
+		}
+		fails++
+		if fails >= downloadRetries {
+			return fmt.Errorf("segment at %d: %w", pos, err)
+		}
+		if alt, _ := dl.d.Alternate(*lb); alt != nil {
+			*lb = alt
+		}
+		select {
+		case <-time.After(downloadRetryWait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+var errDownloadChanged = errors.New("file changed on the server since the download started; delete the .dlstate file to start over")
+
+// fetchRange legge da lb il segmento dalla posizione corrente, scrivendo i dati al loro
+// offset nel file, finché il segmento è completo o la richiesta fallisce
+func (dl *downloader) fetchRange(ctx context.Context, lb *Backend, seg *dlSegment) error {
+	dl.mu.Lock()
+	pos, end := seg.Pos, seg.End
+	dl.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, dl.url, nil)
+	if err != nil {
+		return err
+	}
+	ranged := dl.state.Size >= 0
+	if ranged {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", pos, end-1))
+		if dl.ifRange != "" {
+			req.Header.Set("If-Range", dl.ifRange)
+		}
+	}
+	resp, err := dl.clients[lb].Do(req)
+	if err != nil {
+		return fmt.Errorf("backend %s: %w", lb.Name, err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case ranged && resp.StatusCode == http.StatusOK:
+		return errDownloadChanged
+	case ranged && resp.StatusCode != http.StatusPartialContent,
+		!ranged && resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("backend %s: server replied %s", lb.Name, resp.Status)
+	case ranged && !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", pos)):
+		return fmt.Errorf("backend %s: unexpected Content-Range %q", lb.Name, resp.Header.Get("Content-Range"))
+	}
+	if !ranged {
+		// Senza Range si riparte sempre dall'inizio
+		dl.mu.Lock()
+		dl.done.Add(-seg.Pos)
+		seg.Pos, pos = 0, 0
+		dl.mu.Unlock()
+	}
+
+	buf := relayBufPool.Get().(*[]byte)
+	defer relayBufPool.Put(buf)
+	for {
+		n, rerr := resp.Body.Read(*buf)
+		if n > 0 {
+			dl.mu.Lock()
+			if seg.End >= 0 {
+				n = int(min(int64(n), seg.End-pos))
+			}
+			dl.mu.Unlock()
+			if _, err := dl.out.WriteAt((*buf)[:n], pos); err != nil {
+				return err
+			}
+			pos += int64(n)
+			dl.mu.Lock()
+			seg.Pos = pos
+			seg.fetched += int64(n)
+			done := seg.End >= 0 && pos >= seg.End
+			dl.mu.Unlock()
+			dl.done.Add(int64(n))
+			dl.perLink[lb].Add(int64(n))
+			if done {
+				return nil // anche se il segmento è stato accorciato da un altro worker
+			}
+		}
+		if rerr == io.EOF {
+			if ranged {
+				return io.ErrUnexpectedEOF
+			}
+			dl.mu.Lock()
+			seg.End = pos
+			dl.mu.Unlock()
+			return nil
+		}
+		if rerr != nil {
+			return fmt.Errorf("backend %s: %w", lb.Name, rerr)
+		}
+	}
+}
+
+func (dl *downloader) snapshotLinks() map[*Backend]int64 {
+	m := make(map[*Backend]int64, len(dl.perLink))
+	for b, n := range dl.perLink {
+		m[b] = n.Load()
+	}
+	return m
+}
+
+// progress stampa avanzamento e velocità per backend dall'ultimo campione prev
+func (dl *downloader) progress(prev map[*Backend]int64, interval time.Duration) map[*Backend]int64 {
+	cur := dl.snapshotLinks()
+	var total float64
+	var links []string
+	for b, n := range cur {
+		rate := mbps(n-prev[b], interval)
+		total += rate
+		links = append(links, fmt.Sprintf("%s %.1f", b.Name, rate))
+	}
+	sort.Strings(links)
+	done := dl.done.Load()
+	pct := ""
+	if dl.state.Size > 0 {
+		pct = fmt.Sprintf("%5.1f%% ", float64(done)*100/float64(dl.state.Size))
+	}
+	fmt.Printf("\r%s%d MB  %.1f Mb/s  [%s]   ", pct, done>>20, total, strings.Join(links, ", "))
+	return cur
+}
+
+// save scrive lo stato per la ripresa dopo aver reso persistenti i dati già scritti
+func (dl *downloader) save() error {
+	if dl.state.Size < 0 {
+		return nil
+	}
+	if err := dl.out.Sync(); err != nil {
+		return err
+	}
+	dl.mu.Lock()
+	data, err := json.Marshal(dl.state)
+	dl.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := dl.statPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dl.statPath)
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+func loadDownloadState(file string) (*dlState, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var st dlState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// matches indica se lo stato salvato si riferisce allo stesso file del server
+func (st *dlState) matches(probe *dlState) bool {
+	return probe.Size > 0 && st.URL == probe.URL && st.Size == probe.Size &&
+		st.ETag == probe.ETag && st.LastModified == probe.LastModified
+}
+
+func (st *dlState) downloaded() int64 {
+	if st.Size < 0 {
+		return 0
+	}
+	left := int64(0)
+	for _, seg := range st.Segments {
+		left += max(seg.End-seg.Pos, 0)
+	}
+	return st.Size - left
+}
+
+// verifyDownload controlla dimensione e, se indicato, SHA-256 del file completo
+func verifyDownload(file string, size int64, want string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if size >= 0 && n != size {
+		return fmt.Errorf("%s: size %d, expected %d", file, n, size)
+	}
+	got := hex.EncodeToString(h.Sum(nil))
+	fmt.Printf("%s: %d bytes, sha256 %s\n", file, n, got)
+	if want != "" && !strings.EqualFold(got, want) {
+		return fmt.Errorf("%s: sha256 mismatch, expected %s", file, want)
+	}
+	if want != "" {
+		fmt.Println("checksum OK")
+	}
+	return nil
+}
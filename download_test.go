@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func segState(segs ...*dlSegment) *downloader {
+	return &downloader{state: &dlState{Size: 64 << 20, Segments: segs}}
+}
+
+func TestNextSegmentPrefersFreeSegment(t *testing.T) {
+	done := &dlSegment{Pos: 100, End: 100}
+	busy := &dlSegment{Pos: 0, End: 8 << 20, busy: true, started: time.Now()}
+	free := &dlSegment{Pos: 8 << 20, End: 16 << 20}
+	dl := segState(done, busy, free)
+	if got := dl.nextSegment(); got != free {
+		t.Fatalf("got %+v, want the free segment", got)
+	}
+	if !free.busy || free.started.IsZero() {
+		t.Error("free segment not marked busy")
+	}
+	if len(dl.state.Segments) != 3 {
+		t.Errorf("segments = %d, want no split", len(dl.state.Segments))
+	}
+}
+
+func TestNextSegmentSplitsLargestWhenNew(t *testing.T) {
+	now := time.Now()
+	small := &dlSegment{Pos: 0, End: 4 << 20, busy: true, started: now}
+	large := &dlSegment{Pos: 4 << 20, End: 12 << 20, busy: true, started: now}
+	dl := segState(small, large)
+	seg := dl.nextSegment()
+	if seg == nil {
+		t.Fatal("no segment")
+	}
+	if large.End != 8<<20 || seg.Pos != 8<<20 || seg.End != 12<<20 || !seg.busy {
+		t.Errorf("split = [%d,%d) + [%d,%d), want the largest halved", large.Pos, large.End, seg.Pos, seg.End)
+	}
+	if small.End != 4<<20 {
+		t.Error("smaller segment changed")
+	}
+}
+
+func TestNextSegmentSplitsSlowest(t *testing.T) {
+	started := time.Now().Add(-10 * time.Second)
+	// fast: 8 MB da fare a 1 MB/s = 8 s; slow: 4 MB da fare a 100 KB/s ≈ 40 s
+	fast := &dlSegment{Pos: 0, End: 8 << 20, busy: true, started: started, fetched: 10 << 20}
+	slow := &dlSegment{Pos: 8 << 20, End: 12 << 20, busy: true, started: started, fetched: 1000 << 10}
+	dl := segState(fast, slow)
+	seg := dl.nextSegment()
+	if seg == nil {
+		t.Fatal("no segment")
+	}
+	if slow.End != 10<<20 || seg.Pos != 10<<20 || seg.End != 12<<20 {
+		t.Errorf("split [%d,%d), want the second half of the slow segment", seg.Pos, seg.End)
+	}
+	if fast.End != 8<<20 {
+		t.Error("fast segment split")
+	}
+}
+
+func TestNextSegmentNoWorkLeft(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		segs []*dlSegment
+	}{
+		{"all done", []*dlSegment{{Pos: 10, End: 10}, {Pos: 20, End: 20}}},
+		{"too small to split", []*dlSegment{{Pos: 0, End: 2*downloadMinSplit - 1, busy: true, started: now}}},
+		{"unknown size", []*dlSegment{{Pos: 0, End: -1, busy: true, started: now}}},
+	}
+	for _, tt := range tests {
+		if seg := segState(tt.segs...).nextSegment(); seg != nil {
+			t.Errorf("%s: got [%d,%d), want nil", tt.name, seg.Pos, seg.End)
+		}
+	}
+}
+
+func TestNextSegmentKeepsCoverage(t *testing.T) {
+	const size = 32 << 20
+	dl := segState(&dlSegment{Pos: 0, End: size})
+	// Ogni worker prende lavoro finché non restano segmenti divisibili
+	for range 64 {
+		if dl.nextSegment() == nil {
+			break
+		}
+	}
+	covered := make([]bool, size/downloadMinSplit)
+	for _, seg := range dl.state.Segments {
+		if seg.End-seg.Pos < downloadMinSplit {
+			t.Errorf("segment [%d,%d) below the minimum split", seg.Pos, seg.End)
+		}
+		for off := seg.Pos; off < seg.End; off += downloadMinSplit {
+			i := off / downloadMinSplit
+			if covered[i] {
+				t.Fatalf("byte %d covered twice", off)
+			}
+			covered[i] = true
+		}
+	}
+	for i, c := range covered {
+		if !c {
+			t.Errorf("block at %d not covered", int64(i)*downloadMinSplit)
+		}
+	}
+}
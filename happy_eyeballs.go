@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Ritardo prima di avviare il tentativo successivo (RFC 8305, "Connection Attempt Delay")
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// sortHappyEyeballs alterna le famiglie partendo da IPv6 e scarta quelle
+// per cui il backend non ha un indirizzo sorgente
+func sortHappyEyeballs(lb *Backend, ips []net.IP) []net.IP {
+	src4, src6 := lb.Addrs()
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			if src4 != nil {
+				v4 = append(v4, ip)
+			}
+		} else if src6 != nil {
+			v6 = append(v6, ip)
+		}
+	}
+	out := make([]net.IP, 0, len(v4)+len(v6))
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			out = append(out, v6[i])
+		}
+		if i < len(v4) {
+			out = append(out, v4[i])
+		}
+	}
+	return out
+}
+
+// dialHappyEyeballs prova gli indirizzi in ordine, avviando il successivo dopo
+// happyEyeballsDelay o subito se il precedente fallisce; vince la prima connessione riuscita
+func dialHappyEyeballs(ctx context.Context, lb *Backend, ips []net.IP, port string) (net.Conn, error) {
+	ips = sortHappyEyeballs(lb, ips)
+	switch len(ips) {
+	case 0:
+		return nil, fmt.Errorf("backend %s: no destination address of a usable family: %w", lb.Name, syscall.ENETUNREACH)
+	case 1:
+		return dialIP(ctx, lb, ips[0], port)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	results := make(chan result, len(ips))
+	next, pending := 0, 0
+	launch := func() {
+		ip := ips[next]
+		next++
+		pending++
+		go func() {
+			c, err := dialIP(ctx, lb, ip, port)
+			results <- result{c, err}
+		}()
+	}
+
+	launch()
+	timer := time.NewTimer(happyEyeballsDelay)
+	defer timer.Stop()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Chiude le eventuali connessioni dei tentativi ancora in corso
+				go func(n int) {
+					for ; n > 0; n-- {
+						if late := <-results; late.c != nil {
+							late.c.Close()
+						}
+					}
+				}(pending)
+				return r.c, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(ips) {
+				launch()
+				timer.Reset(happyEyeballsDelay)
+			}
+		case <-timer.C:
+			if next < len(ips) {
+				launch()
+				timer.Reset(happyEyeballsDelay)
+			}
+		}
+	}
+	return nil, firstErr
+}
+
+func dialIP(ctx context.Context, lb *Backend, ip net.IP, port string) (net.Conn, error) {
+	ipv6 := ip.To4() == nil
+	d, err := newBackendDialer(lb, ipv6)
+	if err != nil {
+		return nil, err
+	}
+	// Senza supporto del kernel o del server la connessione resta TCP normale
+	d.SetMultipathTCP(lb.mptcp)
+	network := "tcp4"
+	if ipv6 {
+		network = "tcp6"
+	}
+	return d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+}
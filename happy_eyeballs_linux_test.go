@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// stalledListener ascolta su [::1] con la coda di accept piena: le nuove connessioni
+// restano appese come verso un host che non risponde
+func stalledListener(t *testing.T) int {
+	t.Helper()
+	fd, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { syscall.Close(fd) })
+	if err := syscall.Bind(fd, &syscall.SockaddrInet6{Addr: [16]byte{15: 1}}); err != nil {
+		t.Skip(err)
+	}
+	if err := syscall.Listen(fd, 0); err != nil {
+		t.Fatal(err)
+	}
+	sa, _ := syscall.Getsockname(fd)
+	port := sa.(*syscall.SockaddrInet6).Port
+	c, err := net.Dial("tcp6", net.JoinHostPort("::1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return port
+}
+
+func TestHappyEyeballsStalledIPv6(t *testing.T) {
+	port := stalledListener(t)
+	_, p := listenPort(t, "tcp4", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	lb := loopbackBackend(net.IPv4(127, 0, 0, 1), net.IPv6loopback)
+	start := time.Now()
+	c, err := dialHappyEyeballs(context.Background(), lb, []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	d := time.Since(start)
+	if ip := c.RemoteAddr().(*net.TCPAddr).IP; ip.To4() == nil {
+		t.Errorf("connected to %v, want the IPv4 address", ip)
+	}
+	// IPv6 parte per primo; IPv4 dopo il ritardo, senza attendere il timeout di IPv6
+	if d < happyEyeballsDelay || d > 4*happyEyeballsDelay {
+		t.Errorf("connected after %v, want about %v", d, happyEyeballsDelay)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// loopbackBackend è un backend con gli indirizzi sorgente indicati (nil = famiglia assente)
+func loopbackBackend(v4, v6 net.IP) *Backend {
+	b := &Backend{Name: "lo", Stats: &BackendStats{}}
+	b.addrs.Store(&backendAddrs{v4, v6})
+	return b
+}
+
+// listenPort apre un listener TCP su addr e ne restituisce la porta
+func listenPort(t *testing.T, network, addr string) (net.Listener, string) {
+	t.Helper()
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		t.Skipf("listen %s: %v", addr, err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	return l, strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+}
+
+func TestSortHappyEyeballs(t *testing.T) {
+	a4, b4 := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2")
+	a6, b6 := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+	ips := []net.IP{a4, b4, a6, b6}
+	tests := []struct {
+		name string
+		lb   *Backend
+		want []net.IP
+	}{
+		{"dual stack", loopbackBackend(net.IPv4(127, 0, 0, 1), net.IPv6loopback), []net.IP{a6, a4, b6, b4}},
+		{"ipv4 only", loopbackBackend(net.IPv4(127, 0, 0, 1), nil), []net.IP{a4, b4}},
+		{"ipv6 only", loopbackBackend(nil, net.IPv6loopback), []net.IP{a6, b6}},
+	}
+	for _, tt := range tests {
+		got := sortHappyEyeballs(tt.lb, ips)
+		if !slices.EqualFunc(got, tt.want, net.IP.Equal) {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHappyEyeballsFailsOverAtOnce(t *testing.T) {
+	// Nessuno ascolta su [::1]:port: il rifiuto fa partire subito il tentativo IPv4
+	_, port := listenPort(t, "tcp4", "127.0.0.1:0")
+	lb := loopbackBackend(net.IPv4(127, 0, 0, 1), net.IPv6loopback)
+	start := time.Now()
+	c, err := dialHappyEyeballs(context.Background(), lb, []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if ip := c.RemoteAddr().(*net.TCPAddr).IP; ip.To4() == nil {
+		t.Errorf("connected to %v, want the IPv4 address", ip)
+	}
+	if d := time.Since(start); d >= happyEyeballsDelay {
+		t.Errorf("took %v: a refused attempt should not wait for the delay", d)
+	}
+}
+
+func TestHappyEyeballsAllFail(t *testing.T) {
+	l, port := listenPort(t, "tcp4", "127.0.0.1:0")
+	l.Close()
+	lb := loopbackBackend(net.IPv4(127, 0, 0, 1), net.IPv6loopback)
+	_, err := dialHappyEyeballs(context.Background(), lb, []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}, port)
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("err = %v, want connection refused", err)
+	}
+}
+
+func TestHappyEyeballsNoUsableFamily(t *testing.T) {
+	lb := loopbackBackend(net.IPv4(127, 0, 0, 1), nil)
+	_, err := dialHappyEyeballs(context.Background(), lb, []net.IP{net.IPv6loopback}, "80")
+	if !errors.Is(err, syscall.ENETUNREACH) {
+		t.Errorf("err = %v, want network unreachable", err)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// runHeadless avvia l'applicazione senza finestra: il proxy si controlla
+// interamente dalla dashboard web servita su webAddr, protetta da webToken. Con dnsAddr
+// avvia anche il forwarder DNS.
+func runHeadless(ctrl *Controller, webAddr, webToken, dnsAddr string, dnsRace int) {
+	if webAddr == "" {
+		fmt.Fprintln(os.Stderr, "headless mode requires -web <addr>, e.g. -web 127.0.0.1:9090")
+		os.Exit(2)
+	}
+
+	ctrl.RefreshInterfaces()
+
+	if err := control.Start(webAddr, webToken, ctrl); err != nil {
+		fmt.Fprintf(os.Stderr, "web dashboard: %v\n", err)
+		os.Exit(1)
+	}
+
+	if dnsAddr != "" {
+		if err := dnsForwarder.Start(dnsAddr, dnsRace, ctrl.proxy, ctrl.Logger); err != nil {
+			fmt.Fprintf(os.Stderr, "dns forwarder: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+
+	ctrl.Shutdown()
+	control.Stop()
+	dnsForwarder.Stop()
+}
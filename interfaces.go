@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+type nicInfo struct {
+	ip, ip6, name string // ip è l'indirizzo principale (IPv4 se presente), ip6 l'IPv6 globale
+}
+
+// globalIPv6 indica un IPv6 instradabile su Internet (no link-local, no ULA)
+func globalIPv6(ip net.IP) bool {
+	return ip.To4() == nil && ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+func getValidInterfaces() []nicInfo {
+	var res []nicInfo
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return res
+	}
+
+	// ✓ Filtro interfacce virtuali migliorato
+	virtualPatterns := []string{
+		"virtual", "vbox", "vmware", "vethernet", "veth",
+		"docker", "vpn", "tap", "tun", "host-only",
+	}
+
+	for _, i := range ifaces {
+		lowerName := strings.ToLower(i.Name)
+		isVirtual := false
+		for _, pattern := range virtualPatterns {
+			if strings.Contains(lowerName, pattern) {
+				isVirtual = true
+				break
+			}
+		}
+		if isVirtual {
+			continue
+		}
+
+		if i.Flags&net.FlagUp == 0 || i.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		addrs, err := i.Addrs()
+		if err != nil {
+			continue
+		}
+
+		var v4 []string
+		var v6 string
+		for _, addr := range addrs {
+			var ipAddr net.IP
+			switch v := addr.(type) {
+			case *net.IPNet:
+				ipAddr = v.IP
+			case *net.IPAddr:
+				ipAddr = v.IP
+			}
+			ip := ipAddr.String()
+
+			// ✓ Filtra IP VirtualBox (192.168.56.*) e altri range locali
+			if strings.Count(ip, ".") == 3 &&
+				!strings.HasPrefix(ip, "127.") &&
+				!strings.HasPrefix(ip, "169.254.") &&
+				!strings.HasPrefix(ip, "192.168.56.") {
+				v4 = append(v4, ip)
+			} else if v6 == "" && globalIPv6(ipAddr) {
+				v6 = ip
+			}
+		}
+
+		// Una riga per interfaccia; se solo IPv6 (comune sulle reti mobili) compare con quello
+		if len(v4) > 0 {
+			res = append(res, nicInfo{v4[0], v6, i.Name})
+		} else if v6 != "" {
+			res = append(res, nicInfo{v6, "", i.Name})
+		}
+	}
+	return res
+}
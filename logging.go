@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Sottosistemi usati come attributo "subsystem" nei log
+const (
+	subsysProxy   = "proxy"
+	subsysSocks   = "socks"
+	subsysTunnel  = "tunnel"
+	subsysDNS     = "dns"
+	subsysRouting = "routing"
+	subsysAPI     = "api"
+	subsysGUI     = "gui"
+)
+
+// LevelOff disattiva un sink o un sottosistema
+const LevelOff = slog.Level(100)
+
+// LogEntry è un record di log già estratto dal formato slog, per GUI e dashboard
+type LogEntry struct {
+	Time      time.Time
+	Level     slog.Level
+	Subsystem string
+	Message   string
+	Attrs     []slog.Attr
+}
+
+// Attr restituisce il valore dell'attributo key, o "" se assente
+func (e LogEntry) Attr(key string) string {
+	for _, a := range e.Attrs {
+		if a.Key == key {
+			return a.Value.String()
+		}
+	}
+	return ""
+}
+
+// String formatta la riga come "15:04:05 INFO  [socks] messaggio k=v"
+func (e LogEntry) String() string {
+	var b strings.Builder
+	b.WriteString(e.Time.Format("15:04:05"))
+	fmt.Fprintf(&b, " %-5s", e.Level.String())
+	if e.Subsystem != "" {
+		fmt.Fprintf(&b, " [%s]", e.Subsystem)
+	}
+	b.WriteByte(' ')
+	b.WriteString(e.Message)
+	for _, a := range e.Attrs {
+		v := a.Value.String()
+		if strings.ContainsAny(v, " \t\"") {
+			v = fmt.Sprintf("%q", v)
+		}
+		fmt.Fprintf(&b, " %s=%s", a.Key, v)
+	}
+	return b.String()
+}
+
+func newLogEntry(r slog.Record) LogEntry {
+	e := LogEntry{Time: r.Time, Level: r.Level, Message: r.Message}
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == "subsystem" {
+			e.Subsystem = a.Value.String()
+		} else {
+			e.Attrs = append(e.Attrs, a)
+		}
+		return true
+	})
+	return e
+}
+
+type logSink struct {
+	name    string
+	level   slog.Level
+	handler slog.Handler
+}
+
+// LogRouter smista i record verso più sink (GUI, file, JSON, journald...)
+// con livelli indipendenti per sink e per sottosistema
+type LogRouter struct {
+	mu       sync.RWMutex
+	sinks    []*logSink
+	subsys   map[string]*slog.LevelVar
+	minLevel atomic.Int64 // livello minimo tra i sink, per scartare subito i record inutili
+}
+
+func NewLogRouter() *LogRouter {
+	r := &LogRouter{subsys: make(map[string]*slog.LevelVar)}
+	r.minLevel.Store(int64(LevelOff))
+	return r
+}
+
+// SetSink aggiunge o sostituisce il sink con il nome indicato
+func (r *LogRouter) SetSink(name string, level slog.Level, h slog.Handler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.sinks {
+		if s.name == name {
+			s.handler = h
+			s.level = level
+			r.updateMinLevel()
+			return
+		}
+	}
+	r.sinks = append(r.sinks, &logSink{name: name, level: level, handler: h})
+	r.updateMinLevel()
+}
+
+// SetSinkLevel cambia il livello di un sink esistente (LevelOff per spegnerlo)
+func (r *LogRouter) SetSinkLevel(name string, level slog.Level) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.sinks {
+		if s.name == name {
+			s.level = level
+		}
+	}
+	r.updateMinLevel()
+}
+
+func (r *LogRouter) updateMinLevel() {
+	min := LevelOff
+	for _, s := range r.sinks {
+		if s.level < min {
+			min = s.level
+		}
+	}
+	r.minLevel.Store(int64(min))
+}
+
+// SetSubsystemLevel imposta il livello minimo per un sottosistema, su tutti i sink
+func (r *LogRouter) SetSubsystemLevel(subsystem string, level slog.Level) {
+	r.subsystemVar(subsystem).Set(level)
+}
+
+func (r *LogRouter) subsystemVar(subsystem string) *slog.LevelVar {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	v, ok := r.subsys[subsystem]
+	if !ok {
+		v = new(slog.LevelVar)
+		v.Set(slog.LevelDebug)
+		r.subsys[subsystem] = v
+	}
+	return v
+}
+
+func (r *LogRouter) Logger() *slog.Logger {
+	return slog.New(&routerHandler{r: r})
+}
+
+// routerHandler è lo slog.Handler restituito da LogRouter.Logger
+type routerHandler struct {
+	r      *LogRouter
+	sub    *slog.LevelVar
+	attrs  []slog.Attr
+	prefix string // gruppi aperti con WithGroup, come "gruppo."
+}
+
+func (h *routerHandler) Enabled(_ context.Context, level slog.Level) bool {
+	if level < slog.Level(h.r.minLevel.Load()) {
+		return false
+	}
+	return h.sub == nil || level >= h.sub.Level()
+}
+
+func (h *routerHandler) Handle(ctx context.Context, rec slog.Record) error {
+	// Il sottosistema può arrivare anche come attributo del singolo record
+	if h.sub == nil && h.prefix == "" {
+		var sub string
+		rec.Attrs(func(a slog.Attr) bool {
+			if a.Key == "subsystem" {
+				sub = a.Value.String()
+				return false
+			}
+			return true
+		})
+		if sub != "" && rec.Level < h.r.subsystemVar(sub).Level() {
+			return nil
+		}
+	}
+	out := slog.NewRecord(rec.Time, rec.Level, rec.Message, rec.PC)
+	out.AddAttrs(h.attrs...)
+	rec.Attrs(func(a slog.Attr) bool {
+		a.Key = h.prefix + a.Key
+		out.AddAttrs(a)
+		return true
+	})
+
+	h.r.mu.RLock()
+	defer h.r.mu.RUnlock()
+	for _, s := range h.r.sinks {
+		if rec.Level >= s.level {
+			s.handler.Handle(ctx, out)
+		}
+	}
+	return nil
+}
+
+func (h *routerHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	nh := *h
+	nh.attrs = append(append([]slog.Attr(nil), h.attrs...), attrs...)
+	for i, a := range attrs {
+		nh.attrs[len(h.attrs)+i].Key = h.prefix + a.Key
+		if a.Key == "subsystem" && h.prefix == "" {
+			nh.sub = h.r.subsystemVar(a.Value.String())
+		}
+	}
+	return &nh
+}
+
+func (h *routerHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	nh := *h
+	nh.prefix = h.prefix + name + "."
+	return &nh
+}
+
+// entryHandler consegna ogni record come LogEntry a una funzione (GUI, dashboard)
+type entryHandler struct {
+	fn func(LogEntry)
+}
+
+func (h *entryHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *entryHandler) Handle(_ context.Context, r slog.Record) error {
+	h.fn(newLogEntry(r))
+	return nil
+}
+
+func (h *entryHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *entryHandler) WithGroup(string) slog.Handler      { return h }
+
+// journaldHandler scrive righe con prefisso di priorità "<N>" (sd-daemon),
+// comprese sia da journald che da syslog; data e ora le aggiunge il demone
+type journaldHandler struct {
+	mu  sync.Mutex
+	out io.Writer
+	buf bytes.Buffer
+}
+
+func newJournaldHandler(out io.Writer) *journaldHandler {
+	return &journaldHandler{out: out}
+}
+
+func (h *journaldHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *journaldHandler) Handle(_ context.Context, r slog.Record) error {
+	e := newLogEntry(r)
+	prio := 6 // info
+	switch {
+	case r.Level >= slog.LevelError:
+		prio = 3
+	case r.Level >= slog.LevelWarn:
+		prio = 4
+	case r.Level < slog.LevelInfo:
+		prio = 7
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buf.Reset()
+	fmt.Fprintf(&h.buf, "<%d>", prio)
+	if e.Subsystem != "" {
+		fmt.Fprintf(&h.buf, "%s: ", e.Subsystem)
+	}
+	h.buf.WriteString(e.Message)
+	for _, a := range e.Attrs {
+		fmt.Fprintf(&h.buf, " %s=%q", a.Key, a.Value.String())
+	}
+	h.buf.WriteByte('\n')
+	_, err := h.out.Write(h.buf.Bytes())
+	return err
+}
+
+func (h *journaldHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *journaldHandler) WithGroup(string) slog.Handler      { return h }
+
+// RotatingFile è un io.Writer che ruota il file al superamento di maxBytes,
+// mantenendo al più backups copie (file.1, file.2, ...)
+type RotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	backups  int
+	f        *os.File
+	size     int64
+}
+
+func NewRotatingFile(path string, maxBytes int64, backups int) (*RotatingFile, error) {
+	rf := &RotatingFile{path: path, maxBytes: maxBytes, backups: backups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f = f
+	rf.size = st.Size()
+	return nil
+}
+
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.maxBytes > 0 && rf.size+int64(len(p)) > rf.maxBytes && rf.size > 0 {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *RotatingFile) rotate() error {
+	rf.f.Close()
+	for i := rf.backups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+	}
+	if rf.backups > 0 {
+		os.Rename(rf.path, rf.path+".1")
+	} else {
+		os.Remove(rf.path)
+	}
+	return rf.open()
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.f.Close()
+}
+
+// LogConfig descrive i sink opzionali configurabili da riga di comando
+type LogConfig struct {
+	Level      slog.Level // livello dei sink file/stdout
+	File       string
+	FileMaxMB  int
+	FileKeep   int
+	JSON       bool   // JSON su stdout
+	Journald   bool   // formato journald/syslog su stderr
+	Text       bool   // testo su stdout (modalità headless)
+	Subsystems string // es. "socks=debug,api=warn"
+}
+
+// setupLogging configura i sink e i livelli per sottosistema indicati in cfg
+func setupLogging(r *LogRouter, cfg LogConfig) error {
+	passAll := &slog.HandlerOptions{Level: slog.LevelDebug - 4}
+	if cfg.File != "" {
+		rf, err := NewRotatingFile(cfg.File, int64(cfg.FileMaxMB)*1024*1024, cfg.FileKeep)
+		if err != nil {
+			return fmt.Errorf("log file: %w", err)
+		}
+		r.SetSink("file", cfg.Level, slog.NewTextHandler(rf, passAll))
+	}
+	if cfg.JSON {
+		r.SetSink("json", cfg.Level, slog.NewJSONHandler(os.Stdout, passAll))
+	}
+	if cfg.Journald {
+		r.SetSink("journald", cfg.Level, newJournaldHandler(os.Stderr))
+	}
+	if cfg.Text {
+		r.SetSink("stdout", cfg.Level, slog.NewTextHandler(os.Stdout, passAll))
+	}
+	if cfg.Subsystems == "" {
+		return nil
+	}
+	for _, kv := range strings.Split(cfg.Subsystems, ",") {
+		name, lvl, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok {
+			return fmt.Errorf("invalid subsystem level %q (want name=level)", kv)
+		}
+		level, err := parseLevel(lvl)
+		if err != nil {
+			return err
+		}
+		r.SetSubsystemLevel(name, level)
+	}
+	return nil
+}
+
+// parseLevel accetta debug/info/warn/error/off
+func parseLevel(s string) (slog.Level, error) {
+	if strings.EqualFold(s, "off") {
+		return LevelOff, nil
+	}
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(s)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q", s)
+	}
+	return l, nil
+}
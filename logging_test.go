@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// captureHandler raccoglie i messaggi ricevuti da un sink
+type captureHandler struct {
+	msgs []string
+}
+
+func (h *captureHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *captureHandler) Handle(_ context.Context, r slog.Record) error {
+	h.msgs = append(h.msgs, r.Message)
+	return nil
+}
+func (h *captureHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *captureHandler) WithGroup(string) slog.Handler      { return h }
+
+func TestSubsystemLevel(t *testing.T) {
+	r := NewLogRouter()
+	sink := &captureHandler{}
+	r.SetSink("test", slog.LevelDebug, sink)
+	r.SetSubsystemLevel(subsysProxy, slog.LevelWarn)
+	log := r.Logger()
+
+	log.With("subsystem", subsysProxy).Info("with: dropped")
+	log.With("subsystem", subsysProxy).Warn("with: kept")
+	log.Info("inline: dropped", "subsystem", subsysProxy)
+	log.Warn("inline: kept", "subsystem", subsysProxy)
+	log.Debug("other subsystem: kept", "subsystem", subsysSocks)
+	log.Info("no subsystem: kept")
+
+	want := []string{"with: kept", "inline: kept", "other subsystem: kept", "no subsystem: kept"}
+	if !slices.Equal(sink.msgs, want) {
+		t.Errorf("got %q, want %q", sink.msgs, want)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	rf, err := NewRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+
+	// Ogni scrittura che supererebbe i 10 byte ruota prima il file
+	for _, line := range []string{"aaaa\n", "bbbb\n", "cccc\n", "dddd\n", "eeee\n", "ffff\n", "gggg\n"} {
+		if n, err := rf.Write([]byte(line)); err != nil || n != len(line) {
+			t.Fatalf("Write(%q) = %d, %v", line, n, err)
+		}
+	}
+	if got := readFile(t, path); got != "gggg\n" {
+		t.Errorf("current file = %q", got)
+	}
+	if got := readFile(t, path+".1"); got != "eeee\nffff\n" {
+		t.Errorf("first backup = %q", got)
+	}
+	if got := readFile(t, path+".2"); got != "cccc\ndddd\n" {
+		t.Errorf("second backup = %q", got)
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more backups than configured: %v", err)
+	}
+}
+
+func TestRotatingFileAppendsAndOversizedWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	if err := os.WriteFile(path, []byte("old\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rf, err := NewRotatingFile(path, 8, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+
+	// La dimensione esistente conta per la rotazione; senza backup il file viene sostituito
+	long := strings.Repeat("x", 20) + "\n"
+	rf.Write([]byte(long))
+	if got := readFile(t, path); got != long {
+		t.Errorf("after rotation = %q, want the oversized line alone", got)
+	}
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Errorf("backup kept with backups=0: %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// LogHub distribuisce i messaggi di log ai client della dashboard web (SSE)
+// e ne conserva gli ultimi per chi si collega dopo
+type LogHub struct {
+	mu      sync.Mutex
+	history []string
+	max     int
+	subs    map[chan string]struct{}
+}
+
+func NewLogHub(max int) *LogHub {
+	return &LogHub{max: max, subs: make(map[chan string]struct{})}
+}
+
+// Publish non blocca mai: i client troppo lenti perdono messaggi
+func (h *LogHub) Publish(msg string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.history) >= h.max {
+		h.history = h.history[1:]
+	}
+	h.history = append(h.history, msg)
+	for ch := range h.subs {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+// Subscribe restituisce lo storico, il canale dei nuovi messaggi e la funzione per disiscriversi
+func (h *LogHub) Subscribe() ([]string, <-chan string, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch := make(chan string, 256)
+	h.subs[ch] = struct{}{}
+	history := append([]string(nil), h.history...)
+	cancel := func() {
+		h.mu.Lock()
+		delete(h.subs, ch)
+		h.mu.Unlock()
+	}
+	return history, ch, cancel
+}
+
+// LogRing è un buffer circolare di LogEntry per il visualizzatore della GUI
+type LogRing struct {
+	mu    sync.Mutex
+	buf   []LogEntry
+	start int
+	n     int
+	seq   uint64 // incrementato ad ogni modifica, per sapere se ridisegnare
+}
+
+func NewLogRing(capacity int) *LogRing {
+	return &LogRing{buf: make([]LogEntry, capacity)}
+}
+
+func (r *LogRing) Append(e LogEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.n < len(r.buf) {
+		r.buf[(r.start+r.n)%len(r.buf)] = e
+		r.n++
+	} else {
+		r.buf[r.start] = e
+		r.start = (r.start + 1) % len(r.buf)
+	}
+	r.seq++
+}
+
+func (r *LogRing) Clear() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.start, r.n = 0, 0
+	r.seq++
+}
+
+func (r *LogRing) Seq() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.seq
+}
+
+// Filter restituisce, in ordine cronologico, le righe che soddisfano f
+func (r *LogRing) Filter(f LogFilter) []LogEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]LogEntry, 0, r.n)
+	for i := 0; i < r.n; i++ {
+		e := r.buf[(r.start+i)%len(r.buf)]
+		if f.Match(e) {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// Backends restituisce i valori distinti dell'attributo "backend" presenti nel buffer
+func (r *LogRing) Backends() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	seen := map[string]bool{}
+	var list []string
+	for i := 0; i < r.n; i++ {
+		if b := r.buf[(r.start+i)%len(r.buf)].Attr("backend"); b != "" && !seen[b] {
+			seen[b] = true
+			list = append(list, b)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// LogFilter seleziona le righe per livello minimo, backend e testo
+type LogFilter struct {
+	MinLevel slog.Level
+	Backend  string
+	Text     string // confrontato senza distinzione di maiuscole
+}
+
+func (f LogFilter) Match(e LogEntry) bool {
+	if e.Level < f.MinLevel {
+		return false
+	}
+	if f.Backend != "" && e.Attr("backend") != f.Backend {
+		return false
+	}
+	if f.Text != "" && !strings.Contains(strings.ToLower(e.String()), strings.ToLower(f.Text)) {
+		return false
+	}
+	return true
+}
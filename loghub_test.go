@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log/slog"
+	"slices"
+	"testing"
+)
+
+func ringMessages(list []LogEntry) []string {
+	msgs := make([]string, len(list))
+	for i, e := range list {
+		msgs[i] = e.Message
+	}
+	return msgs
+}
+
+func TestLogRingWrapsInOrder(t *testing.T) {
+	r := NewLogRing(3)
+	seq := r.Seq()
+	for _, m := range []string{"a", "b", "c", "d", "e"} {
+		r.Append(LogEntry{Message: m})
+	}
+	if r.Seq() == seq {
+		t.Error("Seq did not change after Append")
+	}
+	if got := ringMessages(r.Filter(LogFilter{MinLevel: slog.LevelDebug})); !slices.Equal(got, []string{"c", "d", "e"}) {
+		t.Errorf("after wrap = %q, want the last three in order", got)
+	}
+
+	seq = r.Seq()
+	r.Clear()
+	if r.Seq() == seq {
+		t.Error("Seq did not change after Clear")
+	}
+	if got := r.Filter(LogFilter{MinLevel: slog.LevelDebug}); len(got) != 0 {
+		t.Errorf("after Clear = %v", got)
+	}
+	r.Append(LogEntry{Message: "f"})
+	if got := ringMessages(r.Filter(LogFilter{MinLevel: slog.LevelDebug})); !slices.Equal(got, []string{"f"}) {
+		t.Errorf("after Clear and Append = %q", got)
+	}
+}
+
+func TestLogRingFilterAndBackends(t *testing.T) {
+	r := NewLogRing(10)
+	r.Append(LogEntry{Level: slog.LevelDebug, Message: "dial", Attrs: []slog.Attr{slog.String("backend", "wlan0")}})
+	r.Append(LogEntry{Level: slog.LevelInfo, Message: "Connected", Attrs: []slog.Attr{slog.String("backend", "usb0")}})
+	r.Append(LogEntry{Level: slog.LevelWarn, Message: "dial failed", Attrs: []slog.Attr{slog.String("backend", "usb0")}})
+	r.Append(LogEntry{Level: slog.LevelError, Message: "listener failed", Subsystem: subsysProxy})
+
+	tests := []struct {
+		filter LogFilter
+		want   []string
+	}{
+		{LogFilter{MinLevel: slog.LevelDebug}, []string{"dial", "Connected", "dial failed", "listener failed"}},
+		{LogFilter{MinLevel: slog.LevelWarn}, []string{"dial failed", "listener failed"}},
+		{LogFilter{MinLevel: slog.LevelDebug, Backend: "usb0"}, []string{"Connected", "dial failed"}},
+		{LogFilter{MinLevel: slog.LevelDebug, Text: "CONNECTED"}, []string{"Connected"}},
+		{LogFilter{MinLevel: slog.LevelDebug, Text: "wlan0"}, []string{"dial"}},              // anche negli attributi
+		{LogFilter{MinLevel: slog.LevelDebug, Text: "[proxy]"}, []string{"listener failed"}}, // e nel sottosistema
+		{LogFilter{MinLevel: slog.LevelInfo, Backend: "usb0", Text: "failed"}, []string{"dial failed"}},
+	}
+	for _, tt := range tests {
+		if got := ringMessages(r.Filter(tt.filter)); !slices.Equal(got, tt.want) {
+			t.Errorf("Filter(%+v) = %q, want %q", tt.filter, got, tt.want)
+		}
+	}
+	if got := r.Backends(); !slices.Equal(got, []string{"usb0", "wlan0"}) {
+		t.Errorf("Backends() = %q", got)
+	}
+}
+
+func TestLogHubHistory(t *testing.T) {
+	h := NewLogHub(2)
+	h.Publish("a")
+	h.Publish("b")
+	h.Publish("c")
+	history, ch, cancel := h.Subscribe()
+	defer cancel()
+	if !slices.Equal(history, []string{"b", "c"}) {
+		t.Errorf("history = %q", history)
+	}
+	h.Publish("d")
+	if m := <-ch; m != "d" {
+		t.Errorf("received %q, want d", m)
+	}
+}
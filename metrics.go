@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Numero di dial falliti consecutivi oltre il quale un backend è considerato down
+const unhealthyThreshold = 3
+
+// Bucket (in secondi) dell'istogramma della latenza di connessione
+var dialLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Histogram è un istogramma cumulativo lock-free in stile Prometheus
+type Histogram struct {
+	bounds []float64
+	counts []atomic.Uint64
+	count  atomic.Uint64
+	sumNs  atomic.Uint64
+}
+
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds))}
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	secs := d.Seconds()
+	for i, b := range h.bounds {
+		if secs <= b {
+			h.counts[i].Add(1)
+			break
+		}
+	}
+	h.count.Add(1)
+	h.sumNs.Add(uint64(d))
+}
+
+// BackendStats raccoglie i contatori di un singolo backend.
+// Sopravvive ai riavvii del proxy così i counter restano monotoni.
+type BackendStats struct {
+	Name      string
+	Interface string
+
+	BytesUp     atomic.Uint64
+	BytesDown   atomic.Uint64
+	ActiveConns atomic.Int64
+	TotalConns  atomic.Uint64
+	DialLatency *Histogram
+
+	consecutiveFails atomic.Int32
+	failMu           sync.Mutex
+	dialFailures     map[string]uint64
+}
+
+// RecordDial aggiorna latenza, errori e stato di salute dopo un tentativo di dial
+func (b *BackendStats) RecordDial(d time.Duration, err error) {
+	if err == nil {
+		b.DialLatency.Observe(d)
+		b.consecutiveFails.Store(0)
+		return
+	}
+	b.consecutiveFails.Add(1)
+	reason := dialErrorReason(err)
+	b.failMu.Lock()
+	b.dialFailures[reason]++
+	b.failMu.Unlock()
+}
+
+func (b *BackendStats) Healthy() bool {
+	return b.consecutiveFails.Load() < unhealthyThreshold
+}
+
+// ListenerStats conta accept riusciti e falliti di un listener
+type ListenerStats struct {
+	Address      string
+	Accepts      atomic.Uint64
+	AcceptErrors atomic.Uint64
+}
+
+// MetricsRegistry contiene tutte le statistiche esportate su /metrics
+type MetricsRegistry struct {
+	mu        sync.Mutex
+	backends  map[string]*BackendStats
+	listeners map[string]*ListenerStats
+}
+
+var metrics = NewMetricsRegistry()
+
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{
+		backends:  make(map[string]*BackendStats),
+		listeners: make(map[string]*ListenerStats),
+	}
+}
+
+// Backend restituisce (creandole se serve) le statistiche del backend indicato
+func (m *MetricsRegistry) Backend(name, iface string) *BackendStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if b, ok := m.backends[name]; ok {
+		return b
+	}
+	b := &BackendStats{
+		Name:         name,
+		Interface:    iface,
+		DialLatency:  NewHistogram(dialLatencyBuckets),
+		dialFailures: make(map[string]uint64),
+	}
+	m.backends[name] = b
+	return b
+}
+
+// Lookup restituisce le statistiche di un backend già visto, o nil
+func (m *MetricsRegistry) Lookup(name string) *BackendStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.backends[name]
+}
+
+func (m *MetricsRegistry) Listener(addr string) *ListenerStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if l, ok := m.listeners[addr]; ok {
+		return l
+	}
+	l := &ListenerStats{Address: addr}
+	m.listeners[addr] = l
+	return l
+}
+
+// sortedBackends restituisce una copia ordinata per nome, per un output stabile
+func (m *MetricsRegistry) sortedBackends() []*BackendStats {
+	m.mu.Lock()
+	list := make([]*BackendStats, 0, len(m.backends))
+	for _, b := range m.backends {
+		list = append(list, b)
+	}
+	m.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func (m *MetricsRegistry) sortedListeners() []*ListenerStats {
+	m.mu.Lock()
+	list := make([]*ListenerStats, 0, len(m.listeners))
+	for _, l := range m.listeners {
+		list = append(list, l)
+	}
+	m.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Address < list[j].Address })
+	return list
+}
+
+// BackendSnapshot è una copia dei contatori di un backend per le API JSON
+type BackendSnapshot struct {
+	Name        string `json:"name"`
+	Interface   string `json:"interface"`
+	BytesUp     uint64 `json:"bytes_up"`
+	BytesDown   uint64 `json:"bytes_down"`
+	ActiveConns int64  `json:"active_conns"`
+	TotalConns  uint64 `json:"total_conns"`
+	Healthy     bool   `json:"healthy"`
+}
+
+func (m *MetricsRegistry) Snapshot() []BackendSnapshot {
+	backends := m.sortedBackends()
+	list := make([]BackendSnapshot, 0, len(backends))
+	for _, b := range backends {
+		list = append(list, BackendSnapshot{
+			Name:        b.Name,
+			Interface:   b.Interface,
+			BytesUp:     b.BytesUp.Load(),
+			BytesDown:   b.BytesDown.Load(),
+			ActiveConns: b.ActiveConns.Load(),
+			TotalConns:  b.TotalConns.Load(),
+			Healthy:     b.Healthy(),
+		})
+	}
+	return list
+}
+
+// WritePrometheus scrive tutte le metriche nel formato testuale di Prometheus
+func (m *MetricsRegistry) WritePrometheus(w io.Writer) {
+	backends := m.sortedBackends()
+	listeners := m.sortedListeners()
+
+	labels := func(b *BackendStats) string {
+		return fmt.Sprintf(`backend="%s",interface="%s"`, escapeLabel(b.Name), escapeLabel(b.Interface))
+	}
+
+	header(w, "dispatch_backend_bytes_up_total", "counter", "Bytes sent to remote hosts through the backend.")
+	for _, b := range backends {
+		fmt.Fprintf(w, "dispatch_backend_bytes_up_total{%s} %d\n", labels(b), b.BytesUp.Load())
+	}
+	header(w, "dispatch_backend_bytes_down_total", "counter", "Bytes received from remote hosts through the backend.")
+	for _, b := range backends {
+		fmt.Fprintf(w, "dispatch_backend_bytes_down_total{%s} %d\n", labels(b), b.BytesDown.Load())
+	}
+	header(w, "dispatch_backend_active_connections", "gauge", "Connections currently relayed through the backend.")
+	for _, b := range backends {
+		fmt.Fprintf(w, "dispatch_backend_active_connections{%s} %d\n", labels(b), b.ActiveConns.Load())
+	}
+	header(w, "dispatch_backend_connections_total", "counter", "Connections successfully established through the backend.")
+	for _, b := range backends {
+		fmt.Fprintf(w, "dispatch_backend_connections_total{%s} %d\n", labels(b), b.TotalConns.Load())
+	}
+	header(w, "dispatch_backend_dial_failures_total", "counter", "Failed dials through the backend by reason.")
+	for _, b := range backends {
+		b.failMu.Lock()
+		reasons := make([]string, 0, len(b.dialFailures))
+		for r := range b.dialFailures {
+			reasons = append(reasons, r)
+		}
+		sort.Strings(reasons)
+		for _, r := range reasons {
+			fmt.Fprintf(w, "dispatch_backend_dial_failures_total{%s,reason=\"%s\"} %d\n", labels(b), r, b.dialFailures[r])
+		}
+		b.failMu.Unlock()
+	}
+	header(w, "dispatch_backend_dial_duration_seconds", "histogram", "Time to establish outgoing connections through the backend.")
+	for _, b := range backends {
+		h := b.DialLatency
+		var cumulative uint64
+		for i, bound := range h.bounds {
+			cumulative += h.counts[i].Load()
+			fmt.Fprintf(w, "dispatch_backend_dial_duration_seconds_bucket{%s,le=\"%g\"} %d\n", labels(b), bound, cumulative)
+		}
+		count := h.count.Load()
+		fmt.Fprintf(w, "dispatch_backend_dial_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels(b), count)
+		fmt.Fprintf(w, "dispatch_backend_dial_duration_seconds_sum{%s} %g\n", labels(b), time.Duration(h.sumNs.Load()).Seconds())
+		fmt.Fprintf(w, "dispatch_backend_dial_duration_seconds_count{%s} %d\n", labels(b), count)
+	}
+	header(w, "dispatch_backend_up", "gauge", "Whether the backend is considered healthy (1) or down (0).")
+	for _, b := range backends {
+		up := 0
+		if b.Healthy() {
+			up = 1
+		}
+		fmt.Fprintf(w, "dispatch_backend_up{%s} %d\n", labels(b), up)
+	}
+
+	header(w, "dispatch_listener_accepts_total", "counter", "Client connections accepted by the listener.")
+	for _, l := range listeners {
+		fmt.Fprintf(w, "dispatch_listener_accepts_total{listener=\"%s\"} %d\n", escapeLabel(l.Address), l.Accepts.Load())
+	}
+	header(w, "dispatch_listener_accept_errors_total", "counter", "Accept errors returned by the listener.")
+	for _, l := range listeners {
+		fmt.Fprintf(w, "dispatch_listener_accept_errors_total{listener=\"%s\"} %d\n", escapeLabel(l.Address), l.AcceptErrors.Load())
+	}
+}
+
+func header(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
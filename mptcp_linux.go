@@ -0,0 +1,269 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// Costanti generic netlink (linux/genetlink.h) e del path manager MPTCP (linux/mptcp.h)
+const (
+	genlIDCtrl         = 0x10
+	genlHdrLen         = 4
+	ctrlCmdGetFamily   = 3
+	ctrlAttrFamilyID   = 1
+	ctrlAttrFamilyName = 2
+	nlaFNested         = 0x8000
+
+	mptcpPMName          = "mptcp_pm"
+	mptcpPMVersion       = 1
+	mptcpCmdAddAddr      = 1
+	mptcpCmdDelAddr      = 2
+	mptcpCmdGetAddr      = 3
+	mptcpCmdSetLimits    = 5
+	mptcpCmdGetLimits    = 6
+	mptcpAttrAddr        = 1
+	mptcpAttrRcvAddAddrs = 2
+	mptcpAttrSubflows    = 3
+	mptcpAddrAttrFamily  = 1
+	mptcpAddrAttrID      = 2
+	mptcpAddrAttrAddr4   = 3
+	mptcpAddrAttrAddr6   = 4
+	mptcpAddrAttrFlags   = 6
+	mptcpAddrAttrIfIdx   = 7
+	mptcpFlagSubflow     = 0x2
+	mptcpPMAddrMax       = 8 // limite del kernel per endpoint e sottoflussi
+)
+
+// mptcpEndpoint è un endpoint del path manager MPTCP in-kernel (ip mptcp endpoint)
+type mptcpEndpoint struct {
+	ID      uint8
+	Addr    net.IP
+	IfIndex int
+	Flags   uint32
+}
+
+// mptcpPM è una connessione generic netlink alla famiglia mptcp_pm
+type mptcpPM struct {
+	*nlConn
+	family uint16
+}
+
+func openMPTCPPM() (*mptcpPM, error) {
+	nl, err := openNL(syscall.NETLINK_GENERIC)
+	if err != nil {
+		return nil, err
+	}
+	family, err := nl.genlFamily(mptcpPMName)
+	if err != nil {
+		nl.Close()
+		if errors.Is(err, syscall.ENOENT) {
+			return nil, errors.New("the kernel has no MPTCP path manager (CONFIG_MPTCP)")
+		}
+		return nil, err
+	}
+	return &mptcpPM{nlConn: nl, family: family}, nil
+}
+
+// genlFamily risolve il numero di una famiglia generic netlink dal nome
+func (c *nlConn) genlFamily(name string) (uint16, error) {
+	msg := rtAttr(genlHdr(ctrlCmdGetFamily, 1), ctrlAttrFamilyName, append([]byte(name), 0))
+	msgs, err := c.request(genlIDCtrl, 0, msg)
+	if err != nil {
+		return 0, err
+	}
+	for _, m := range msgs {
+		for _, a := range nlAttrs(m.Data[min(genlHdrLen, len(m.Data)):]) {
+			if a.Attr.Type == ctrlAttrFamilyID && len(a.Value) >= 2 {
+				return binary.NativeEndian.Uint16(a.Value), nil
+			}
+		}
+	}
+	return 0, syscall.ENOENT
+}
+
+func genlHdr(cmd, version uint8) []byte {
+	return []byte{cmd, version, 0, 0}
+}
+
+// nlAttrs scompone una sequenza di attributi netlink
+func nlAttrs(b []byte) []syscall.NetlinkRouteAttr {
+	var out []syscall.NetlinkRouteAttr
+	for len(b) >= syscall.SizeofRtAttr {
+		l := int(binary.NativeEndian.Uint16(b[0:]))
+		if l < syscall.SizeofRtAttr || l > len(b) {
+			break
+		}
+		out = append(out, syscall.NetlinkRouteAttr{
+			Attr:  syscall.RtAttr{Len: uint16(l), Type: binary.NativeEndian.Uint16(b[2:]) &^ nlaFNested},
+			Value: b[syscall.SizeofRtAttr:l],
+		})
+		b = b[min((l+syscall.RTA_ALIGNTO-1) & ^(syscall.RTA_ALIGNTO-1), len(b)):]
+	}
+	return out
+}
+
+// endpoints elenca gli endpoint configurati
+func (pm *mptcpPM) endpoints() ([]mptcpEndpoint, error) {
+	msgs, err := pm.request(pm.family, syscall.NLM_F_DUMP, genlHdr(mptcpCmdGetAddr, mptcpPMVersion))
+	if err != nil {
+		return nil, err
+	}
+	var list []mptcpEndpoint
+	for _, m := range msgs {
+		for _, a := range nlAttrs(m.Data[min(genlHdrLen, len(m.Data)):]) {
+			if a.Attr.Type != mptcpAttrAddr {
+				continue
+			}
+			var ep mptcpEndpoint
+			for _, f := range nlAttrs(a.Value) {
+				switch {
+				case f.Attr.Type == mptcpAddrAttrID && len(f.Value) >= 1:
+					ep.ID = f.Value[0]
+				case f.Attr.Type == mptcpAddrAttrAddr4 && len(f.Value) == 4,
+					f.Attr.Type == mptcpAddrAttrAddr6 && len(f.Value) == 16:
+					ep.Addr = net.IP(append([]byte(nil), f.Value...))
+				case f.Attr.Type == mptcpAddrAttrIfIdx && len(f.Value) >= 4:
+					ep.IfIndex = int(int32(binary.NativeEndian.Uint32(f.Value)))
+				case f.Attr.Type == mptcpAddrAttrFlags && len(f.Value) >= 4:
+					ep.Flags = binary.NativeEndian.Uint32(f.Value)
+				}
+			}
+			list = append(list, ep)
+		}
+	}
+	return list, nil
+}
+
+// addEndpoint aggiunge un endpoint "subflow" su ip: il kernel apre da lì sottoflussi
+// aggiuntivi delle connessioni MPTCP uscenti
+func (pm *mptcpPM) addEndpoint(ip net.IP, ifindex int) error {
+	family, addr := ipFamily(ip)
+	typ := uint16(mptcpAddrAttrAddr4)
+	if family == syscall.AF_INET6 {
+		typ = mptcpAddrAttrAddr6
+	}
+	var fam [2]byte
+	binary.NativeEndian.PutUint16(fam[:], uint16(family))
+	var inner []byte
+	inner = rtAttr(inner, mptcpAddrAttrFamily, fam[:])
+	inner = rtAttr(inner, typ, addr)
+	inner = rtAttrU32(inner, mptcpAddrAttrIfIdx, uint32(ifindex))
+	inner = rtAttrU32(inner, mptcpAddrAttrFlags, mptcpFlagSubflow)
+	msg := rtAttr(genlHdr(mptcpCmdAddAddr, mptcpPMVersion), mptcpAttrAddr|nlaFNested, inner)
+	_, err := pm.request(pm.family, syscall.NLM_F_ACK, msg)
+	return err
+}
+
+func (pm *mptcpPM) delEndpoint(id uint8) error {
+	inner := rtAttr(nil, mptcpAddrAttrID, []byte{id})
+	msg := rtAttr(genlHdr(mptcpCmdDelAddr, mptcpPMVersion), mptcpAttrAddr|nlaFNested, inner)
+	_, err := pm.request(pm.family, syscall.NLM_F_ACK, msg)
+	return err
+}
+
+// limits restituisce i limiti del path manager: sottoflussi per connessione e indirizzi
+// annunciati dal server accettati
+func (pm *mptcpPM) limits() (subflows, addAddrs uint32, err error) {
+	msgs, err := pm.request(pm.family, 0, genlHdr(mptcpCmdGetLimits, mptcpPMVersion))
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, m := range msgs {
+		for _, a := range nlAttrs(m.Data[min(genlHdrLen, len(m.Data)):]) {
+			if len(a.Value) < 4 {
+				continue
+			}
+			switch a.Attr.Type {
+			case mptcpAttrSubflows:
+				subflows = binary.NativeEndian.Uint32(a.Value)
+			case mptcpAttrRcvAddAddrs:
+				addAddrs = binary.NativeEndian.Uint32(a.Value)
+			}
+		}
+	}
+	return subflows, addAddrs, nil
+}
+
+func (pm *mptcpPM) setLimits(subflows, addAddrs uint32) error {
+	msg := genlHdr(mptcpCmdSetLimits, mptcpPMVersion)
+	msg = rtAttrU32(msg, mptcpAttrRcvAddAddrs, addAddrs)
+	msg = rtAttrU32(msg, mptcpAttrSubflows, subflows)
+	_, err := pm.request(pm.family, syscall.NLM_F_ACK, msg)
+	return err
+}
+
+// installMPTCPEndpoints aggiunge un endpoint "subflow" per ogni indirizzo del backend e
+// alza se serve il limite di sottoflussi, così una connessione MPTCP aperta da qualunque
+// backend usa anche le altre interfacce. Gli endpoint già presenti restano di chi li ha
+// creati; i limiti alzati non vengono riportati indietro.
+func installMPTCPEndpoints(b *Backend) ([]func() error, error) {
+	if b.Interface == "" {
+		return nil, errors.New("backend has no interface")
+	}
+	iface, err := net.InterfaceByName(b.Interface)
+	if err != nil {
+		return nil, err
+	}
+	pm, err := openMPTCPPM()
+	if err != nil {
+		return nil, err
+	}
+	defer pm.Close()
+
+	var undo []func() error
+	v4, v6 := b.Addrs()
+	for _, ip := range []net.IP{v4, v6} {
+		if ip == nil {
+			continue
+		}
+		switch err := pm.addEndpoint(ip, iface.Index); {
+		case err == nil:
+			undo = append(undo, func() error { return removeMPTCPEndpoint(ip) })
+		case errors.Is(err, syscall.EEXIST), errors.Is(err, syscall.EBUSY):
+		case errors.Is(err, syscall.EPERM):
+			return undo, fmt.Errorf("%w (needs root or CAP_NET_ADMIN)", err)
+		default:
+			return undo, fmt.Errorf("endpoint %s: %w", ip, err)
+		}
+	}
+
+	eps, err := pm.endpoints()
+	if err != nil {
+		return undo, err
+	}
+	want := uint32(min(len(eps), mptcpPMAddrMax))
+	subflows, addAddrs, err := pm.limits()
+	if err != nil {
+		return undo, err
+	}
+	if subflows < want || addAddrs < want {
+		if err := pm.setLimits(max(subflows, want), max(addAddrs, want)); err != nil {
+			return undo, fmt.Errorf("limits: %w", err)
+		}
+	}
+	return undo, nil
+}
+
+// removeMPTCPEndpoint toglie l'endpoint con indirizzo ip, cercandone l'ID assegnato dal kernel
+func removeMPTCPEndpoint(ip net.IP) error {
+	pm, err := openMPTCPPM()
+	if err != nil {
+		return err
+	}
+	defer pm.Close()
+	eps, err := pm.endpoints()
+	if err != nil {
+		return err
+	}
+	for _, ep := range eps {
+		if ep.Addr.Equal(ip) {
+			return pm.delEndpoint(ep.ID)
+		}
+	}
+	return nil
+}
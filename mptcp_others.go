@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func installMPTCPEndpoints(b *Backend) ([]func() error, error) {
+	return nil, errors.New("MPTCP endpoints are only supported on Linux")
+}
@@ -0,0 +1,261 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// Costanti rtnetlink (linux/rtnetlink.h, linux/fib_rules.h) non esportate da syscall
+const (
+	rtaTable     = 15
+	rtaMark      = 16
+	fraSrc       = 2
+	fraPriority  = 6
+	fraFwmark    = 10
+	fraTable     = 15
+	frActToTable = 1
+	rtTableMain  = 254
+	rtprotStatic = 4
+	rtScopeLink  = 253
+)
+
+// nlConn è un socket netlink per richieste sincrone: rtnetlink (route get, regole, rotte)
+// o generic netlink (path manager MPTCP)
+type nlConn struct {
+	fd  int
+	seq uint32
+}
+
+func newNLConn() (*nlConn, error) {
+	return openNL(syscall.NETLINK_ROUTE)
+}
+
+func openNL(proto int) (*nlConn, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, fmt.Errorf("netlink socket: %w", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("netlink bind: %w", err)
+	}
+	return &nlConn{fd: fd}, nil
+}
+
+func (c *nlConn) Close() {
+	syscall.Close(c.fd)
+}
+
+// request invia un messaggio e raccoglie le risposte fino a NLMSG_DONE, all'ACK
+// o alla singola risposta di una richiesta non-dump; un errore del kernel diventa errno
+func (c *nlConn) request(typ, flags uint16, payload []byte) ([]syscall.NetlinkMessage, error) {
+	c.seq++
+	msg := make([]byte, syscall.NLMSG_HDRLEN+len(payload))
+	hdr := (*syscall.NlMsghdr)(unsafe.Pointer(&msg[0]))
+	hdr.Len = uint32(len(msg))
+	hdr.Type = typ
+	hdr.Flags = syscall.NLM_F_REQUEST | flags
+	hdr.Seq = c.seq
+	copy(msg[syscall.NLMSG_HDRLEN:], payload)
+	if err := syscall.Sendto(c.fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	var out []syscall.NetlinkMessage
+	buf := make([]byte, 1<<16)
+	for {
+		n, _, err := syscall.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		// I messaggi restano riferiti ai byte ricevuti: copia perché buf viene riusato
+		msgs, err := syscall.ParseNetlinkMessage(append([]byte(nil), buf[:n]...))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != c.seq {
+				continue
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return out, nil
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) >= 4 {
+					if errno := int32(binary.NativeEndian.Uint32(m.Data)); errno != 0 {
+						return nil, syscall.Errno(-errno)
+					}
+				}
+				return out, nil // ACK
+			}
+			out = append(out, m)
+			if m.Header.Flags&syscall.NLM_F_MULTI == 0 && flags&syscall.NLM_F_ACK == 0 {
+				return out, nil
+			}
+		}
+	}
+}
+
+// rtAttr accoda un attributo netlink allineato a 4 byte
+func rtAttr(b []byte, typ uint16, data []byte) []byte {
+	l := syscall.SizeofRtAttr + len(data)
+	a := make([]byte, (l+syscall.RTA_ALIGNTO-1) & ^(syscall.RTA_ALIGNTO-1))
+	binary.NativeEndian.PutUint16(a[0:], uint16(l))
+	binary.NativeEndian.PutUint16(a[2:], typ)
+	copy(a[syscall.SizeofRtAttr:], data)
+	return append(b, a...)
+}
+
+func rtAttrU32(b []byte, typ uint16, v uint32) []byte {
+	var d [4]byte
+	binary.NativeEndian.PutUint32(d[:], v)
+	return rtAttr(b, typ, d[:])
+}
+
+// rtMsg impacchetta l'intestazione rtmsg, che ha lo stesso formato di fib_rule_hdr
+func rtMsg(m syscall.RtMsg) []byte {
+	b := make([]byte, syscall.SizeofRtMsg)
+	*(*syscall.RtMsg)(unsafe.Pointer(&b[0])) = m
+	return b
+}
+
+// ipFamily restituisce la famiglia e l'IP nella forma corta (4 o 16 byte)
+func ipFamily(ip net.IP) (uint8, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return syscall.AF_INET, ip4
+	}
+	return syscall.AF_INET6, ip.To16()
+}
+
+// nlRoute è una rotta letta dal kernel
+type nlRoute struct {
+	Table   uint32
+	DstLen  uint8
+	OIF     int
+	Gateway net.IP
+	PrefSrc net.IP
+}
+
+func parseRoute(m syscall.NetlinkMessage) (nlRoute, bool) {
+	if m.Header.Type != syscall.RTM_NEWROUTE || len(m.Data) < syscall.SizeofRtMsg {
+		return nlRoute{}, false
+	}
+	rtm := (*syscall.RtMsg)(unsafe.Pointer(&m.Data[0]))
+	r := nlRoute{Table: uint32(rtm.Table), DstLen: rtm.Dst_len}
+	attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+	if err != nil {
+		return r, true
+	}
+	for _, a := range attrs {
+		switch a.Attr.Type {
+		case syscall.RTA_OIF:
+			r.OIF = int(binary.NativeEndian.Uint32(a.Value))
+		case syscall.RTA_GATEWAY:
+			r.Gateway = net.IP(a.Value)
+		case syscall.RTA_PREFSRC:
+			r.PrefSrc = net.IP(a.Value)
+		case rtaTable:
+			r.Table = binary.NativeEndian.Uint32(a.Value)
+		}
+	}
+	return r, true
+}
+
+// routeGet chiede al kernel la rotta scelta per dst con sorgente src (come "ip route get
+// dst from src [oif dev] [mark m]"); oif e mark a zero non vengono passati
+func (c *nlConn) routeGet(src, dst net.IP, oif int, mark uint32) (nlRoute, error) {
+	fam, dst := ipFamily(dst)
+	_, src = ipFamily(src)
+	bits := uint8(len(dst) * 8)
+	p := rtMsg(syscall.RtMsg{Family: fam, Dst_len: bits, Src_len: bits})
+	p = rtAttr(p, syscall.RTA_DST, dst)
+	p = rtAttr(p, syscall.RTA_SRC, src)
+	if oif != 0 {
+		p = rtAttrU32(p, syscall.RTA_OIF, uint32(oif))
+	}
+	if mark != 0 {
+		p = rtAttrU32(p, rtaMark, mark)
+	}
+	msgs, err := c.request(syscall.RTM_GETROUTE, 0, p)
+	if err != nil {
+		return nlRoute{}, err
+	}
+	for _, m := range msgs {
+		if r, ok := parseRoute(m); ok {
+			return r, nil
+		}
+	}
+	return nlRoute{}, fmt.Errorf("no route to %s", dst)
+}
+
+// defaultGateway cerca nella tabella main la rotta di default dell'interfaccia
+func (c *nlConn) defaultGateway(ifindex int, family uint8) (net.IP, bool, error) {
+	msgs, err := c.request(syscall.RTM_GETROUTE, syscall.NLM_F_DUMP, rtMsg(syscall.RtMsg{Family: family}))
+	if err != nil {
+		return nil, false, err
+	}
+	for _, m := range msgs {
+		r, ok := parseRoute(m)
+		if ok && r.DstLen == 0 && r.Table == rtTableMain && r.OIF == ifindex {
+			return r.Gateway, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// routeAdd aggiunge "default [via gw] dev ifindex table table"
+func (c *nlConn) routeAdd(family uint8, table uint32, ifindex int, gw net.IP, del bool) error {
+	m := syscall.RtMsg{Family: family, Table: syscall.RT_TABLE_UNSPEC, Protocol: rtprotStatic, Type: syscall.RTN_UNICAST}
+	if gw == nil {
+		m.Scope = rtScopeLink
+	}
+	p := rtMsg(m)
+	p = rtAttrU32(p, rtaTable, table)
+	p = rtAttrU32(p, syscall.RTA_OIF, uint32(ifindex))
+	if gw != nil {
+		_, gw = ipFamily(gw)
+		p = rtAttr(p, syscall.RTA_GATEWAY, gw)
+	}
+	typ, flags := uint16(syscall.RTM_NEWROUTE), uint16(syscall.NLM_F_ACK|syscall.NLM_F_CREATE|syscall.NLM_F_EXCL)
+	if del {
+		typ, flags = syscall.RTM_DELROUTE, syscall.NLM_F_ACK
+	}
+	_, err := c.request(typ, flags, p)
+	return err
+}
+
+// nlRule è una regola "[from Src] [fwmark Mark] lookup Table priority Priority"
+type nlRule struct {
+	Family   uint8
+	Src      net.IP
+	Mark     uint32
+	Table    uint32
+	Priority uint32
+}
+
+// ruleAdd aggiunge (o con del rimuove) la regola
+func (c *nlConn) ruleAdd(r nlRule, del bool) error {
+	m := syscall.RtMsg{Family: r.Family, Table: syscall.RT_TABLE_UNSPEC, Type: frActToTable}
+	var attrs []byte
+	if r.Src != nil {
+		_, src := ipFamily(r.Src)
+		m.Src_len = uint8(len(src) * 8)
+		attrs = rtAttr(attrs, fraSrc, src)
+	}
+	if r.Mark != 0 {
+		attrs = rtAttrU32(attrs, fraFwmark, r.Mark)
+	}
+	attrs = rtAttrU32(attrs, fraPriority, r.Priority)
+	attrs = rtAttrU32(attrs, fraTable, r.Table)
+	typ, flags := uint16(syscall.RTM_NEWRULE), uint16(syscall.NLM_F_ACK|syscall.NLM_F_CREATE|syscall.NLM_F_EXCL)
+	if del {
+		typ, flags = syscall.RTM_DELRULE, syscall.NLM_F_ACK
+	}
+	_, err := c.request(typ, flags, append(rtMsg(m), attrs...))
+	return err
+}
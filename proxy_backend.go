@@ -1,36 +1,141 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"io"
+	"log/slog"
 	"math/big"
 	"net"
+	"net/url"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
-	// "time" rimossa perché non usata
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
-// LoggerFunc definisce come inviare i log alla GUI
-type LoggerFunc func(string)
-
 // ProxyServer gestisce lo stato del server
 type ProxyServer struct {
 	listener    net.Listener
 	running     bool
+	tunnel      bool
 	stopChan    chan struct{}
 	dispatcher  *Dispatcher
-	log         LoggerFunc
+	log         *slog.Logger
+	socksLog    *slog.Logger
+	tunnelLog   *slog.Logger
+	connIDs     atomic.Uint64
 	mu          sync.Mutex
-	activeConns sync.WaitGroup
+	activeConns *sync.WaitGroup // connessioni dell'avvio corrente
+	listenStats *ListenerStats
+	conns       ConnTracker
+	accessLog   atomic.Pointer[AccessLogger]
+	dnsServers  []string // server DNS configurati, al posto di quelli delle interfacce
+	changeHook  func(name string)
+	policyRoute bool                // crea tabelle e regole per sorgente (Linux, richiede CAP_NET_ADMIN)
+	mptcp       bool                // connessioni uscenti MPTCP (Linux)
+	mptcpEPs    bool                // crea gli endpoint MPTCP dei backend (Linux, richiede CAP_NET_ADMIN)
+	routing     *PolicyRouting      // non nil mentre il proxy è attivo con policyRoute o mptcpEPs
+	staleRoute  *PolicyRouting      // regole di un arresto precedente, tenute per le connessioni ancora aperte
+	bindModes   map[string]BindMode // per nome di backend; assente = auto
+	marks       map[string]uint32   // fwmark per nome di backend
+	idleTimeout atomic.Int64        // chiusura dopo questo tempo senza traffico, 0 = mai
+	dialRace    atomic.Int64        // ritardo del dial in gara su un secondo backend, 0 = disattivato
+	keepAlive   net.KeepAliveConfig // keepalive TCP di entrambi i lati
+	keepAliveOK bool                // keepAlive impostato, altrimenti defaultKeepAlive
 }
 
+// Keepalive TCP di default: sonde dopo 30 s di silenzio, peer morto dopo altri 30 s
+var defaultKeepAlive = net.KeepAliveConfig{Enable: true, Idle: 30 * time.Second, Interval: 10 * time.Second, Count: 3}
+
+// Tempo massimo per aprire una connessione verso un backend
+const backendDialTimeout = 10 * time.Second
+
+// Intervallo di rilettura degli indirizzi dei backend, oltre agli eventi di rete
+const backendAddrRefresh = 5 * time.Second
+
+// Un backend non sano riceve una sola connessione ogni unhealthyProbeTurns turni:
+// fa da sonda, e un dial riuscito lo riporta nella rotazione piena
+const unhealthyProbeTurns = 8
+
 // Backend rappresenta un'interfaccia di uscita
 type Backend struct {
+	Name               string // IP locale (SOCKS) o target (tunnel)
 	Address            string
 	Interface          string
+	ByInterface        bool // dichiarato per nome di interfaccia: gli indirizzi seguono i cambi DHCP
 	ContentionRatio    int
 	CurrentConnections int
+	Stats              *BackendStats
+	Resolver           *BackendResolver // nil in modalità tunnel
+	Bind               BindMode         // come legare le connessioni all'interfaccia (SOCKS)
+	Mark               uint32           // fwmark (SO_MARK) dei socket del backend, 0 = nessuno
+	Upstream           *url.URL         // proxy a monte (SOCKS5 o HTTP CONNECT) o relay del bonding al posto di un'interfaccia
+
+	keepAlive net.KeepAliveConfig // keepalive delle connessioni uscenti
+	mptcp     bool                // chiede MPTCP alle connessioni uscenti, con fallback su TCP
+	bondLanes func() []*Backend   // backend bond: interfacce su cui aprire i tunnel verso il relay
+
+	addrs        atomic.Pointer[backendAddrs] // indirizzi sorgente (SOCKS)
+	down         atomic.Bool                  // interfaccia sparita o spenta: esclusa dal dispatcher
+	skippedTurns int                          // turni saltati perché non sano (mutex del dispatcher)
+	onAddrChange func(b *Backend, old, cur backendAddrs)
+}
+
+// backendAddrs sono gli indirizzi sorgente di un backend, nil se la famiglia manca
+type backendAddrs struct {
+	v4, v6 net.IP
+}
+
+func (a backendAddrs) equal(o backendAddrs) bool {
+	return a.v4.Equal(o.v4) && a.v6.Equal(o.v6)
+}
+
+func (a backendAddrs) String() string {
+	var parts []string
+	for _, ip := range []net.IP{a.v4, a.v6} {
+		if ip != nil {
+			parts = append(parts, ip.String())
+		}
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, ",")
+}
+
+// Down indica se il backend è escluso perché la sua interfaccia non c'è più
+func (b *Backend) Down() bool {
+	return b.down.Load()
+}
+
+// Addrs restituisce gli indirizzi sorgente correnti del backend
+func (b *Backend) Addrs() (v4, v6 net.IP) {
+	if a := b.addrs.Load(); a != nil {
+		return a.v4, a.v6
+	}
+	return nil, nil
+}
+
+// refreshAddrs rilegge gli indirizzi dell'interfaccia per i backend dichiarati per nome
+// e segnala il cambio; restituisce true se sono cambiati
+func (b *Backend) refreshAddrs() bool {
+	if !b.ByInterface {
+		return false
+	}
+	v4, v6 := interfaceAddrs(b.Interface)
+	cur := backendAddrs{v4, v6}
+	old := b.addrs.Swap(&cur)
+	if old != nil && old.equal(cur) {
+		return false
+	}
+	if old != nil && b.onAddrChange != nil {
+		b.onAddrChange(b, *old, cur)
+	}
+	return old != nil
 }
 
 // Dispatcher gestisce il round-robin pesato
@@ -38,26 +143,89 @@ type Dispatcher struct {
 	backends []*Backend
 	mu       sync.Mutex
 	index    int
+	spread   int // rotazione per Healthy, indipendente dal round-robin delle connessioni
 }
 
 func NewDispatcher(backends []*Backend) *Dispatcher {
 	return &Dispatcher{backends: backends, index: 0}
 }
 
+// Next sceglie il backend del turno: salta quelli spenti e, finché ce n'è almeno uno
+// sano, dà a quelli non sani solo un turno ogni unhealthyProbeTurns
 func (d *Dispatcher) Next() (*Backend, int) {
 	d.mu.Lock()
 	defer d.mu.Unlock()
-	if len(d.backends) == 0 {
-		return nil, -1
+	anyHealthy := slices.ContainsFunc(d.backends, func(b *Backend) bool {
+		return !b.Down() && b.Stats.Healthy()
+	})
+	for range d.backends {
+		lb := d.backends[d.index]
+		idx := d.index
+		if lb.Down() {
+			lb.CurrentConnections = 0
+			d.index = (d.index + 1) % len(d.backends)
+			continue
+		}
+		if anyHealthy && !lb.Stats.Healthy() {
+			// Una connessione di prova e poi il turno passa al successivo
+			lb.CurrentConnections = 0
+			d.index = (d.index + 1) % len(d.backends)
+			if lb.skippedTurns++; lb.skippedTurns < unhealthyProbeTurns {
+				continue
+			}
+			lb.skippedTurns = 0
+			return lb, idx
+		}
+		lb.CurrentConnections++
+		if lb.CurrentConnections >= lb.ContentionRatio {
+			lb.CurrentConnections = 0
+			d.index = (d.index + 1) % len(d.backends)
+		}
+		return lb, idx
+	}
+	return nil, -1
+}
+
+// Add aggiunge backend al dispatcher in esecuzione (interfacce collegate a caldo)
+func (d *Dispatcher) Add(list ...*Backend) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.backends = append(d.backends, list...)
+}
+
+// Remove toglie i backend con i nomi indicati e li restituisce; il turno del
+// round-robin resta sul backend che lo aveva
+func (d *Dispatcher) Remove(names ...string) []*Backend {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var kept, removed []*Backend
+	shift := 0
+	for i, b := range d.backends {
+		if !slices.Contains(names, b.Name) {
+			kept = append(kept, b)
+			continue
+		}
+		removed = append(removed, b)
+		if i < d.index {
+			shift++
+		}
+	}
+	d.backends = kept
+	d.index -= shift
+	if d.index >= len(kept) {
+		d.index = 0
 	}
-	lb := d.backends[d.index]
-	idx := d.index
-	lb.CurrentConnections++
-	if lb.CurrentConnections >= lb.ContentionRatio {
-		lb.CurrentConnections = 0
-		d.index = (d.index + 1) % len(d.backends)
+	if d.spread >= len(kept) {
+		d.spread = 0
 	}
-	return lb, idx
+	return removed
+}
+
+// Backends restituisce una copia dei backend
+func (d *Dispatcher) Backends() []*Backend {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]*Backend(nil), d.backends...)
 }
 
 func (d *Dispatcher) GetNextFailed(failedIndices *big.Int) (*Backend, int) {
@@ -65,15 +233,59 @@ func (d *Dispatcher) GetNextFailed(failedIndices *big.Int) (*Backend, int) {
 	defer d.mu.Unlock()
 	for i := 0; i < len(d.backends); i++ {
 		idx := (d.index + i) % len(d.backends)
-		if failedIndices.Bit(idx) == 0 {
+		if failedIndices.Bit(idx) == 0 && !d.backends[idx].Down() {
 			return d.backends[idx], idx
 		}
 	}
 	return nil, -1
 }
 
+// Alternate restituisce il primo backend attivo e sano diverso da skip, a partire dal
+// turno corrente del round-robin, senza consumarlo; nil se non ce n'è
+func (d *Dispatcher) Alternate(skip *Backend) (*Backend, int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i := 0; i < len(d.backends); i++ {
+		idx := (d.index + i) % len(d.backends)
+		b := d.backends[idx]
+		if b != skip && !b.Down() && b.Stats.Healthy() {
+			return b, idx
+		}
+	}
+	return nil, -1
+}
+
+// Healthy restituisce fino a n backend distinti e sani, ruotando il primo a ogni chiamata.
+// Se nessun backend è sano li considera tutti, per non restare senza uscita.
+func (d *Dispatcher) Healthy(n int) []*Backend {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.backends) == 0 {
+		return nil
+	}
+	start := d.spread
+	d.spread = (d.spread + 1) % len(d.backends)
+
+	var list, unhealthy []*Backend
+	for i := 0; i < len(d.backends) && len(list) < n; i++ {
+		b := d.backends[(start+i)%len(d.backends)]
+		if b.Down() {
+			continue
+		}
+		if b.Stats.Healthy() {
+			list = append(list, b)
+		} else {
+			unhealthy = append(unhealthy, b)
+		}
+	}
+	if len(list) == 0 {
+		list = unhealthy[:min(n, len(unhealthy))]
+	}
+	return list
+}
+
 // Start avvia il proxy
-func (s *ProxyServer) Start(lhost string, lport int, tunnelMode bool, backendsConf []string, logger LoggerFunc) error {
+func (s *ProxyServer) Start(lhost string, lport int, tunnelMode bool, backendsConf []string, logger *slog.Logger) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -81,29 +293,123 @@ func (s *ProxyServer) Start(lhost string, lport int, tunnelMode bool, backendsCo
 		return fmt.Errorf("server already running")
 	}
 
-	s.log = logger
+	s.log = logger.With("subsystem", subsysProxy)
+	s.socksLog = logger.With("subsystem", subsysSocks)
+	s.tunnelLog = logger.With("subsystem", subsysTunnel)
 	backends := parseLoadBalancers(backendsConf, tunnelMode)
 	if len(backends) == 0 {
 		return fmt.Errorf("no backends selected")
 	}
 
+	if !s.keepAliveOK {
+		s.keepAlive = defaultKeepAlive
+	}
+	for _, b := range backends {
+		b.keepAlive = s.keepAlive
+		b.mptcp = s.mptcp && !tunnelMode
+	}
+	s.removeStaleRouting()
+	if !tunnelMode {
+		s.prepareBackends(backends, logger)
+		if s.policyRoute || s.mptcpEPs {
+			s.routing = NewPolicyRouting(logger.With("subsystem", subsysRouting), s.policyRoute, s.mptcpEPs)
+			for _, b := range backends {
+				s.routing.Apply(b)
+			}
+		}
+		s.logRoutingChecks(backends)
+	}
+
 	s.dispatcher = NewDispatcher(backends)
-	bindAddr := fmt.Sprintf("%s:%d", lhost, lport)
-	l, err := net.Listen("tcp4", bindAddr)
+	s.prepareBonds(backends, logger)
+	// "::" ascolta in dual-stack, un indirizzo specifico solo sulla sua famiglia
+	bindAddr := net.JoinHostPort(lhost, strconv.Itoa(lport))
+	lc := net.ListenConfig{KeepAlive: keepAlivePeriod(s.keepAlive), KeepAliveConfig: s.keepAlive}
+	l, err := lc.Listen(context.Background(), "tcp", bindAddr)
 	if err != nil {
+		s.removeRouting()
 		return err
 	}
 
 	s.listener = l
+	s.listenStats = metrics.Listener(bindAddr)
 	s.running = true
+	s.tunnel = tunnelMode
 	s.stopChan = make(chan struct{})
+	s.activeConns = new(sync.WaitGroup)
 
-	s.log(fmt.Sprintf("[INFO] Server started on %s (Mode: Tunnel=%v)", bindAddr, tunnelMode))
+	s.log.Info("server started", "listen", bindAddr, "tunnel", tunnelMode, "backends", len(backends))
 
-	go s.acceptLoop(tunnelMode)
+	go s.acceptLoop(tunnelMode, s.activeConns)
+	go s.sampleLoop(s.stopChan)
+	if !tunnelMode {
+		go s.addrLoop(s.stopChan)
+	}
 	return nil
 }
 
+// debugEnabled evita di costruire gli attributi dei log per-connessione se DEBUG è spento
+func debugEnabled(l *slog.Logger) bool {
+	return l.Enabled(context.Background(), slog.LevelDebug)
+}
+
+// dnsBackends restituisce i backend su cui inoltrare una query DNS (nil se il proxy
+// è fermo o in modalità tunnel, dove i backend non hanno un resolver)
+func (s *ProxyServer) dnsBackends(n int) []*Backend {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.running || s.dispatcher == nil {
+		return nil
+	}
+	var list []*Backend
+	for _, b := range s.dispatcher.Healthy(n) {
+		if b.Resolver != nil {
+			list = append(list, b)
+		}
+	}
+	return list
+}
+
+// Connections restituisce il tracker delle connessioni attive
+func (s *ProxyServer) Connections() *ConnTracker {
+	return &s.conns
+}
+
+// sampleLoop aggiorna ogni secondo i rate delle connessioni attive
+func (s *ProxyServer) sampleLoop(stop chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.conns.sampleRates(time.Second)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// addrLoop rilegge periodicamente stato e indirizzi dei backend: copre i sistemi senza
+// eventi di rete e gli eventi persi (un telefono che si riconnette con un nuovo indirizzo)
+func (s *ProxyServer) addrLoop(stop chan struct{}) {
+	ticker := time.NewTicker(backendAddrRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.UpdateBackendStates()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (s *ProxyServer) Running() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running
+}
+
 func (s *ProxyServer) Stop() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -115,10 +421,32 @@ func (s *ProxyServer) Stop() {
 	if s.listener != nil {
 		s.listener.Close()
 	}
-	s.log("[INFO] Server stopped, waiting for connections to drain...")
+	// Le connessioni aperte continuano: le loro regole di routing si tolgono quando finiscono
+	if r := s.routing; r != nil {
+		s.routing, s.staleRoute = nil, r
+		conns := s.activeConns
+		go func() {
+			conns.Wait()
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.staleRoute == r {
+				s.removeStaleRouting()
+			}
+		}()
+	}
+	s.log.Info("server stopped, waiting for connections to drain")
+}
+
+// Close ferma il proxy all'uscita dell'applicazione: le regole di routing si tolgono
+// subito, senza attendere le connessioni aperte
+func (s *ProxyServer) Close() {
+	s.Stop()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeStaleRouting()
 }
 
-func (s *ProxyServer) acceptLoop(tunnel bool) {
+func (s *ProxyServer) acceptLoop(tunnel bool, active *sync.WaitGroup) {
 	for {
 		conn, err := s.listener.Accept()
 		if err != nil {
@@ -126,18 +454,21 @@ func (s *ProxyServer) acceptLoop(tunnel bool) {
 			case <-s.stopChan:
 				return // Stop normale
 			default:
-				s.log(fmt.Sprintf("[ERR] Accept: %v", err))
+				s.listenStats.AcceptErrors.Add(1)
+				s.log.Error("accept failed", "listen", s.listenStats.Address, "error", err)
 				continue
 			}
 		}
+		s.listenStats.Accepts.Add(1)
+		id := s.connIDs.Add(1)
 
-		s.activeConns.Add(1)
+		active.Add(1)
 		go func(c net.Conn) {
-			defer s.activeConns.Done()
+			defer active.Done()
 			if tunnel {
-				s.handleTunnel(c)
+				s.handleTunnel(c, id)
 			} else {
-				s.handleSocks(c)
+				s.handleSocks(c, id)
 			}
 		}(conn)
 	}
@@ -146,37 +477,74 @@ func (s *ProxyServer) acceptLoop(tunnel bool) {
 func parseLoadBalancers(args []string, isTunnel bool) []*Backend {
 	list := make([]*Backend, 0, len(args))
 	for _, arg := range args {
-		parts := strings.Split(arg, "@")
-		addrPart := parts[0]
-		ratio := 1
-		if len(parts) > 1 {
-			if r, err := strconv.Atoi(parts[1]); err == nil && r > 0 {
-				ratio = r
+		addrPart, ratio := splitWeight(arg)
+
+		var fullAddr, iface, name string
+		if !isTunnel && strings.Contains(addrPart, "://") {
+			u, err := parseUpstream(addrPart)
+			if err != nil {
+				continue
 			}
+			name = upstreamName(u)
+			list = append(list, &Backend{
+				Name:            name,
+				Address:         u.Host,
+				Upstream:        u,
+				ContentionRatio: ratio,
+				Stats:           metrics.Backend(name, ""),
+			})
+			continue
 		}
-
-		var fullAddr, iface string
 		if isTunnel {
 			host, portStr, _ := net.SplitHostPort(addrPart)
 			p, _ := strconv.Atoi(portStr)
 			fullAddr = fmt.Sprintf("%s:%d", host, p)
+			name = fullAddr
+		} else if ip := net.ParseIP(addrPart); ip != nil {
+			name = ip.String()
+			fullAddr = net.JoinHostPort(name, "0")
+			iface = getInterfaceFromIP(name)
+		} else if addrPart != "" {
+			// Nome di interfaccia: può anche non esistere ancora (telefono scollegato)
+			name, fullAddr, iface = addrPart, addrPart, addrPart
 		} else {
-			if net.ParseIP(addrPart) == nil {
-				continue
-			}
-			fullAddr = fmt.Sprintf("%s:0", addrPart)
-			iface = getInterfaceFromIP(addrPart)
+			continue
 		}
 
-		list = append(list, &Backend{
+		b := &Backend{
+			Name:            name,
 			Address:         fullAddr,
 			Interface:       iface,
+			ByInterface:     !isTunnel && name == iface,
 			ContentionRatio: ratio,
-		})
+			Stats:           metrics.Backend(name, iface),
+		}
+		if !isTunnel {
+			// L'IP indicato vale per la sua famiglia; l'altra si prende dalla stessa interfaccia
+			v4, v6 := interfaceAddrs(iface)
+			if ip := net.ParseIP(name); ip.To4() != nil {
+				v4 = ip
+			} else if ip != nil {
+				v6 = ip
+			}
+			b.addrs.Store(&backendAddrs{v4, v6})
+		}
+		list = append(list, b)
 	}
 	return list
 }
 
+// splitWeight separa "backend@peso"; il peso è dopo l'ultima '@', perché quelle
+// precedenti possono essere le credenziali di un URL
+func splitWeight(arg string) (string, int) {
+	if i := strings.LastIndex(arg, "@"); i >= 0 {
+		if r, err := strconv.Atoi(arg[i+1:]); err == nil {
+			return arg[:i], max(r, 1)
+		}
+	}
+	return arg, 1
+}
+
 func getInterfaceFromIP(ip string) string {
 	ifaces, _ := net.Interfaces()
 	for _, iface := range ifaces {
@@ -195,18 +563,643 @@ func getInterfaceFromIP(ip string) string {
 	return ""
 }
 
-func pipe(local, remote net.Conn) {
-	done := make(chan struct{}, 2)
-	cp := func(dst, src net.Conn) {
-		io.Copy(dst, src)
-		if c, ok := dst.(*net.TCPConn); ok {
-			c.CloseWrite()
+// interfaceAddrs restituisce il primo IPv4 e il primo IPv6 globale dell'interfaccia
+func interfaceAddrs(name string) (v4, v6 net.IP) {
+	if name == "" {
+		return nil, nil
+	}
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, nil
+	}
+	addrs, _ := iface.Addrs()
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ip4 := ipnet.IP.To4(); ip4 != nil {
+			if v4 == nil && !ip4.IsLoopback() && !ip4.IsLinkLocalUnicast() {
+				v4 = ip4
+			}
+		} else if v6 == nil && globalIPv6(ipnet.IP) {
+			v6 = ipnet.IP
+		}
+	}
+	return v4, v6
+}
+
+// localAddr restituisce l'indirizzo sorgente del backend per la famiglia richiesta
+func (b *Backend) localAddr(ipv6 bool) (*net.TCPAddr, error) {
+	v4, v6 := b.Addrs()
+	ip, family := v4, "IPv4"
+	if ipv6 {
+		ip, family = v6, "IPv6"
+	}
+	if ip == nil {
+		return nil, fmt.Errorf("backend %s has no %s address: %w", b.Name, family, syscall.ENETUNREACH)
+	}
+	return &net.TCPAddr{IP: ip}, nil
+}
+
+// DialBackend sceglie il prossimo backend dal dispatcher e apre la connessione verso remoteAddr;
+// con race > 0 mette in gara un secondo backend (vedi dialRace)
+func DialBackend(d *Dispatcher, remoteAddr string, race time.Duration) (net.Conn, *Backend, int, error) {
+	lb, idx := d.Next()
+	if lb == nil {
+		return nil, nil, -1, fmt.Errorf("no backends available")
+	}
+	if race > 0 {
+		return dialRace(d, lb, idx, remoteAddr, race)
+	}
+	c, err := dialVia(context.Background(), lb, remoteAddr)
+	return c, lb, idx, err
+}
+
+// dialVia apre una connessione uscente legata al backend, registrando latenza ed errori.
+// I nomi a dominio sono risolti con il resolver del backend, non con quello di sistema.
+// Un dial interrotto perché ctx è stato annullato non conta come errore del backend.
+func dialVia(ctx context.Context, lb *Backend, remoteAddr string) (net.Conn, error) {
+	start := time.Now()
+	var c net.Conn
+	var err error
+	if lb.Upstream != nil && lb.Upstream.Scheme == "bond" {
+		c, err = dialBond(ctx, lb, remoteAddr)
+	} else if lb.Upstream != nil {
+		c, err = dialUpstream(ctx, lb, remoteAddr)
+	} else {
+		c, err = dialHost(ctx, lb, remoteAddr)
+	}
+	if err == nil || ctx.Err() == nil {
+		lb.Stats.RecordDial(time.Since(start), err)
+	}
+	return c, err
+}
+
+func dialHost(ctx context.Context, lb *Backend, remoteAddr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, backendDialTimeout)
+	defer cancel()
+
+	// Gli indirizzi sono quelli aggiornati da UpdateBackendStates (eventi di rete e addrLoop)
+	v4, v6 := lb.Addrs()
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else if lb.Resolver != nil {
+		ips, err = lb.Resolver.LookupIP(ctx, host, v4 != nil, v6 != nil)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, &net.DNSError{Err: "no resolver for backend", Name: host}
+	}
+	return dialHappyEyeballs(ctx, lb, ips, port)
+}
+
+// dialTunnel connette direttamente al target di un backend in modalità tunnel
+func dialTunnel(lb *Backend) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: backendDialTimeout, KeepAlive: keepAlivePeriod(lb.keepAlive), KeepAliveConfig: lb.keepAlive}
+	start := time.Now()
+	c, err := dialer.Dial("tcp", lb.Address)
+	lb.Stats.RecordDial(time.Since(start), err)
+	return c, err
+}
+
+// dialErrorReason classifica un errore di dial per le metriche
+func dialErrorReason(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ENETUNREACH):
+		return "network_unreachable"
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return "host_unreachable"
+	case errors.Is(err, syscall.EPERM):
+		return "permission"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	default:
+		return "other"
+	}
+}
+
+// connRequest raccoglie i dati della richiesta di un client, per relay e access log
+type connRequest struct {
+	ID       uint64
+	Method   string // CONNECT (SOCKS5) o TUNNEL
+	Accepted time.Time
+	Dest     string
+	DialTime time.Duration
+}
+
+// relay registra la connessione tra quelle attive e inoltra il traffico
+// aggiornando le statistiche del backend; al termine scrive l'access log
+func (s *ProxyServer) relay(req connRequest, local, remote net.Conn, lb *Backend, idx int) *ConnInfo {
+	remoteIP, _, _ := net.SplitHostPort(remote.RemoteAddr().String())
+	ci := &ConnInfo{
+		ID:       req.ID,
+		Method:   req.Method,
+		Client:   local.RemoteAddr().String(),
+		Dest:     req.Dest,
+		RemoteIP: remoteIP,
+		Backend:  lb.Name,
+		LBIndex:  idx,
+		Start:    req.Accepted,
+		DialTime: req.DialTime,
+		client:   local,
+		remote:   remote,
+	}
+	if tc, ok := remote.(*net.TCPConn); ok && lb.mptcp {
+		ci.MPTCP, _ = tc.MultipathTCP()
+	}
+	s.conns.Add(ci)
+	lb.Stats.ActiveConns.Add(1)
+	lb.Stats.TotalConns.Add(1)
+	ci.CloseReason = pipe(local, remote, &ci.ConnStats, lb.Stats, time.Duration(s.idleTimeout.Load()))
+	if ci.killed.Load() {
+		ci.CloseReason = closeKilled
+	}
+	lb.Stats.ActiveConns.Add(-1)
+	s.conns.Remove(ci.ID)
+
+	if al := s.accessLog.Load(); al != nil {
+		al.Log(AccessRecord{
+			Time:        ci.Start,
+			ConnID:      ci.ID,
+			Client:      ci.Client,
+			Method:      ci.Method,
+			Dest:        ci.Dest,
+			RemoteIP:    ci.RemoteIP,
+			Backend:     ci.Backend,
+			DialTime:    ci.DialTime,
+			Duration:    time.Since(ci.Start),
+			BytesUp:     ci.BytesUp.Load(),
+			BytesDown:   ci.BytesDown.Load(),
+			CloseReason: ci.CloseReason,
+		})
+	}
+	return ci
+}
+
+// logDialFailure scrive nell'access log una connessione terminata senza riuscire il dial
+func (s *ProxyServer) logDialFailure(req connRequest, client net.Conn, backend string, err error) {
+	al := s.accessLog.Load()
+	if al == nil {
+		return
+	}
+	al.Log(AccessRecord{
+		Time:        req.Accepted,
+		ConnID:      req.ID,
+		Client:      client.RemoteAddr().String(),
+		Method:      req.Method,
+		Dest:        req.Dest,
+		Backend:     backend,
+		DialTime:    req.DialTime,
+		Duration:    time.Since(req.Accepted),
+		CloseReason: "dial_" + dialErrorReason(err),
+	})
+}
+
+// prepareBackends collega resolver e notifiche di cambio indirizzo ai backend SOCKS
+func (s *ProxyServer) prepareBackends(backends []*Backend, logger *slog.Logger) {
+	dnsLog := logger.With("subsystem", subsysDNS)
+	for _, b := range backends {
+		if b.Upstream != nil {
+			continue // il proxy a monte risolve i nomi e sceglie l'uscita da sé
+		}
+		b.Resolver = newBackendResolver(b, s.dnsServers, dnsLog)
+		if m, ok := s.bindModes[b.Name]; ok {
+			b.Bind = m
+		}
+		b.Mark = s.marks[b.Name]
+		b.onAddrChange = s.backendAddrChanged
+		if b.ByInterface {
+			b.down.Store(!interfaceUp(b.Interface))
+		}
+	}
+}
+
+// TestBackend restituisce il backend arg (nome di interfaccia o URL di un proxy a monte) per
+// una misura: quello del dispatcher se il proxy SOCKS è attivo, altrimenti uno configurato
+// come all'avvio (binding, fwmark, resolver), che non tocca il routing del proxy
+func (s *ProxyServer) TestBackend(arg string, logger *slog.Logger) *Backend {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running && !s.tunnel {
+		for _, b := range s.dispatcher.Backends() {
+			if b.Name == arg {
+				return b
+			}
+		}
+	}
+	return s.standaloneBackend(arg, logger)
+}
+
+// standaloneBackend crea un backend SOCKS fuori dal dispatcher, senza notifiche di cambio
+// indirizzo né policy routing; va chiamata con s.mu acquisito
+func (s *ProxyServer) standaloneBackend(arg string, logger *slog.Logger) *Backend {
+	list := parseLoadBalancers([]string{arg}, false)
+	if len(list) == 0 {
+		return nil
+	}
+	b := list[0]
+	b.keepAlive = s.keepAlive
+	if !s.keepAliveOK {
+		b.keepAlive = defaultKeepAlive
+	}
+	b.mptcp = s.mptcp
+	s.prepareBackends(list, logger)
+	b.onAddrChange = nil
+	return b
+}
+
+// prepareBonds collega ai backend bond le interfacce da usare come lane: quelle indicate
+// con ?via= nell'URL (anche se non selezionate come backend) oppure tutte le interfacce
+// attive del dispatcher. Va chiamata con s.mu acquisito, dopo aver creato il dispatcher.
+func (s *ProxyServer) prepareBonds(backends []*Backend, logger *slog.Logger) {
+	d := s.dispatcher
+	for _, b := range backends {
+		if b.Upstream == nil || b.Upstream.Scheme != "bond" {
+			continue
+		}
+		via := b.Upstream.Query()["via"]
+		own := map[string]*Backend{}
+		for _, name := range via {
+			if bondFind(d.Backends(), name) == nil {
+				if lane := s.standaloneBackend(name, logger); lane != nil {
+					own[name] = lane
+				}
+			}
+		}
+		b.bondLanes = func() []*Backend {
+			all := d.Backends()
+			var lanes, unhealthy []*Backend
+			add := func(lane *Backend) {
+				switch {
+				case lane == nil || lane.Upstream != nil || lane.Down():
+				case lane.Stats.Healthy():
+					lanes = append(lanes, lane)
+				default:
+					unhealthy = append(unhealthy, lane)
+				}
+			}
+			if len(via) == 0 {
+				for _, lane := range all {
+					add(lane)
+				}
+			}
+			for _, name := range via {
+				if lane := bondFind(all, name); lane != nil {
+					add(lane)
+				} else {
+					add(own[name])
+				}
+			}
+			if len(lanes) == 0 {
+				return unhealthy // meglio una lane in difficoltà che nessuna
+			}
+			return lanes
+		}
+	}
+}
+
+// bondFind cerca un backend di interfaccia per nome o per interfaccia
+func bondFind(list []*Backend, name string) *Backend {
+	for _, b := range list {
+		if b.Upstream == nil && (b.Name == name || b.Interface == name) {
+			return b
+		}
+	}
+	return nil
+}
+
+// AddBackends aggiunge al proxy SOCKS in esecuzione i backend indicati ("iface@peso")
+// che non sono già presenti; restituisce i nomi aggiunti
+func (s *ProxyServer) AddBackends(args []string, logger *slog.Logger) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.running || s.tunnel {
+		return nil
+	}
+	existing := map[string]bool{}
+	for _, b := range s.dispatcher.Backends() {
+		existing[b.Name] = true
+	}
+	var added []*Backend
+	var names []string
+	for _, b := range parseLoadBalancers(args, false) {
+		if !existing[b.Name] {
+			added = append(added, b)
+			names = append(names, b.Name)
+		}
+	}
+	if len(added) > 0 {
+		for _, b := range added {
+			b.keepAlive = s.keepAlive
+			b.mptcp = s.mptcp
+		}
+		s.prepareBackends(added, logger)
+		if s.routing != nil {
+			for _, b := range added {
+				s.routing.Apply(b)
+			}
+		}
+		s.logRoutingChecks(added)
+		s.dispatcher.Add(added...)
+		s.prepareBonds(added, logger)
+	}
+	return names
+}
+
+// RemoveBackends toglie dal dispatcher in esecuzione i backend con i nomi indicati, con le
+// loro regole di routing; le connessioni già aperte continuano. Restituisce i nomi tolti.
+func (s *ProxyServer) RemoveBackends(names []string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.running || s.tunnel {
+		return nil
+	}
+	var out []string
+	for _, b := range s.dispatcher.Remove(names...) {
+		b.onAddrChange = nil
+		if s.routing != nil {
+			s.routing.Remove(b.Name)
+		}
+		out = append(out, b.Name)
+	}
+	return out
+}
+
+// UpdateBackendStates rilegge stato e indirizzi delle interfacce dei backend:
+// quelli la cui interfaccia è sparita o spenta vengono esclusi subito dal dispatcher
+func (s *ProxyServer) UpdateBackendStates() {
+	s.mu.Lock()
+	if !s.running || s.tunnel {
+		s.mu.Unlock()
+		return
+	}
+	backends := s.dispatcher.Backends()
+	s.mu.Unlock()
+
+	for _, b := range backends {
+		if !b.ByInterface {
+			continue
+		}
+		down := !interfaceUp(b.Interface)
+		if b.down.Swap(down) != down {
+			if down {
+				s.log.Warn("backend down, interface gone", "backend", b.Name)
+			} else {
+				s.log.Info("backend up again", "backend", b.Name)
+				// L'interfaccia può essere tornata con un altro indice: si rifanno le regole
+				if r := s.policyRouting(); r != nil {
+					r.Apply(b)
+				}
+			}
+		}
+		if !down {
+			b.refreshAddrs()
 		}
-		done <- struct{}{}
 	}
-	go cp(local, remote)
-	go cp(remote, local)
+}
+
+// interfaceUp indica se l'interfaccia esiste ed è attiva
+func interfaceUp(name string) bool {
+	iface, err := net.InterfaceByName(name)
+	return err == nil && iface.Flags&net.FlagUp != 0
+}
+
+// SetBackendChangeHook registra una funzione chiamata quando un backend cambia indirizzo
+func (s *ProxyServer) SetBackendChangeHook(fn func(name string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.changeHook = fn
+}
+
+// backendAddrChanged aggiorna il resolver del backend e avvisa GUI e dashboard
+func (s *ProxyServer) backendAddrChanged(b *Backend, old, cur backendAddrs) {
+	s.log.Info("backend address changed", "backend", b.Name, "interface", b.Interface, "old", old.String(), "new", cur.String())
+	if b.Resolver != nil {
+		b.Resolver.reload()
+	}
+	if r := s.policyRouting(); r != nil {
+		r.Apply(b)
+	}
+	s.mu.Lock()
+	hook := s.changeHook
+	s.mu.Unlock()
+	if hook != nil {
+		hook(b.Name)
+	}
+}
+
+// SetPolicyRouting abilita la creazione di tabelle e regole di routing per sorgente
+// per ogni backend SOCKS, rimosse all'arresto. Ha effetto al prossimo avvio.
+func (s *ProxyServer) SetPolicyRouting(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policyRoute = enabled
+}
+
+// SetMPTCP abilita MPTCP sulle connessioni uscenti dei backend SOCKS (con ripiego su TCP
+// se il server non lo supporta) e, con endpoints, la creazione di un endpoint "subflow"
+// del path manager per ogni backend, rimosso all'arresto. Ha effetto al prossimo avvio.
+func (s *ProxyServer) SetMPTCP(dial, endpoints bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mptcp, s.mptcpEPs = dial, endpoints
+}
+
+func (s *ProxyServer) policyRouting() *PolicyRouting {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.routing
+}
+
+// removeRouting annulla le regole create all'avvio; va chiamata con s.mu acquisito
+func (s *ProxyServer) removeRouting() {
+	if s.routing != nil {
+		s.routing.RemoveAll()
+		s.routing = nil
+	}
+}
+
+// removeStaleRouting toglie le regole lasciate da un arresto precedente; va chiamata
+// con s.mu acquisito
+func (s *ProxyServer) removeStaleRouting() {
+	if s.staleRoute != nil {
+		s.staleRoute.RemoveAll()
+		s.staleRoute = nil
+	}
+}
+
+// RoutingChecks verifica l'instradamento dei backend SOCKS in esecuzione
+func (s *ProxyServer) RoutingChecks() []RouteCheck {
+	s.mu.Lock()
+	if !s.running || s.tunnel {
+		s.mu.Unlock()
+		return nil
+	}
+	backends := s.dispatcher.Backends()
+	s.mu.Unlock()
+	return checkRouting(backends)
+}
+
+// logRoutingChecks avvisa dei backend il cui traffico uscirebbe da un'altra interfaccia
+func (s *ProxyServer) logRoutingChecks(backends []*Backend) {
+	for _, c := range checkRouting(backends) {
+		if !c.OK {
+			s.log.Warn("backend misrouted", "backend", c.Backend, "source", c.Source, "via", c.Via, "problem", c.Problem)
+		}
+	}
+}
+
+// SetBindMode imposta il modo di binding di un backend SOCKS. Ha effetto al prossimo
+// avvio o quando il backend viene aggiunto a proxy attivo.
+func (s *ProxyServer) SetBindMode(name string, mode BindMode) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.bindModes == nil {
+		s.bindModes = make(map[string]BindMode)
+	}
+	s.bindModes[name] = mode
+}
+
+// SetBackendMark imposta il fwmark dei socket di un backend SOCKS (0 = nessuno), in aggiunta
+// al binding per IP o interfaccia: così le regole "ip rule fwmark" e nftables esistenti
+// possono scegliere l'uscita. Ha effetto come SetBindMode.
+func (s *ProxyServer) SetBackendMark(name string, mark uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.marks == nil {
+		s.marks = make(map[string]uint32)
+	}
+	s.marks[name] = mark
+}
+
+// SetDialRace abilita il dial in gara su due backend: il secondo parte dopo delay se il
+// primo non ha ancora finito (0 = disattivato, vale subito per le nuove connessioni)
+func (s *ProxyServer) SetDialRace(delay time.Duration) {
+	s.dialRace.Store(int64(delay))
+}
+
+// SetConnTimeouts imposta il timeout di inattività delle connessioni inoltrate (0 = nessuno,
+// vale subito per le nuove connessioni) e il keepalive TCP di client e backend (dal prossimo avvio;
+// Enable false lo disattiva)
+func (s *ProxyServer) SetConnTimeouts(idle time.Duration, keepAlive net.KeepAliveConfig) {
+	s.idleTimeout.Store(int64(idle))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keepAlive, s.keepAliveOK = keepAlive, true
+}
+
+// keepAlivePeriod è il campo KeepAlive di Dialer e ListenConfig: negativo disattiva
+// il keepalive, che con KeepAliveConfig.Enable false resterebbe quello di default
+func keepAlivePeriod(cfg net.KeepAliveConfig) time.Duration {
+	if cfg.Enable {
+		return 0
+	}
+	return -1
+}
+
+// SetDNSServers imposta i server DNS usati da tutti i backend; vuoto = quelli di ogni interfaccia.
+// Ha effetto al prossimo avvio.
+func (s *ProxyServer) SetDNSServers(servers []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dnsServers = servers
+}
+
+// SetAccessLog abilita (o con nil disabilita) l'access log per connessione
+func (s *ProxyServer) SetAccessLog(al *AccessLogger) {
+	s.accessLog.Store(al)
+}
+
+// Motivi di chiusura registrati per ogni connessione
+const (
+	closeClient      = "client_closed"
+	closeRemote      = "remote_closed"
+	closeClientError = "client_error"
+	closeRemoteError = "remote_error"
+	closeKilled      = "killed"
+	closeIdle        = "idle_timeout"
+)
+
+// pipe copia in entrambe le direzioni contando i byte per connessione e per backend, finché
+// sono terminate tutte e due: l'EOF di un lato arriva all'altro come half-close (CloseWrite),
+// così la risposta a un client che ha chiuso in scrittura non viene troncata; un errore
+// chiude subito entrambi. Con idle > 0 la connessione si chiude dopo quel tempo senza
+// traffico in nessuna direzione. Restituisce il motivo di chiusura, deciso dalla prima
+// direzione che termina.
+func pipe(local, remote net.Conn, cs *ConnStats, bs *BackendStats, idle time.Duration) string {
+	type result struct {
+		fromClient bool
+		err        error
+		halfClosed bool
+	}
+	closeBoth := func() {
+		local.Close()
+		remote.Close()
+	}
+
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
+	var idleHit atomic.Bool
+	if idle > 0 {
+		var timer *time.Timer
+		timer = time.AfterFunc(idle, func() {
+			since := time.Since(time.Unix(0, lastActive.Load()))
+			if since < idle {
+				timer.Reset(idle - since)
+				return
+			}
+			idleHit.Store(true)
+			closeBoth()
+		})
+		defer timer.Stop()
+	}
+
+	done := make(chan result, 2)
+	cp := func(dst, src net.Conn, conn, backend *atomic.Uint64, fromClient bool) {
+		err := copyCounted(dst, src, conn, backend, &lastActive)
+		r := result{fromClient: fromClient, err: err}
+		if err == nil {
+			if hc, ok := dst.(interface{ CloseWrite() error }); ok {
+				r.halfClosed = hc.CloseWrite() == nil
+			}
+		}
+		done <- r
+	}
+	go cp(local, remote, &cs.BytesDown, &bs.BytesDown, false)
+	go cp(remote, local, &cs.BytesUp, &bs.BytesUp, true)
+
+	first := <-done
+	if first.err != nil || !first.halfClosed {
+		// Errore, o lato che non sa chiudere solo in scrittura: non c'è altro da attendere
+		closeBoth()
+	}
 	<-done
-	local.Close()
-	remote.Close()
+	closeBoth()
+
+	switch {
+	case idleHit.Load():
+		return closeIdle
+	case first.fromClient && first.err == nil:
+		return closeClient
+	case first.fromClient:
+		return closeClientError
+	case first.err == nil:
+		return closeRemote
+	default:
+		return closeRemoteError
+	}
 }
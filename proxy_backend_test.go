@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair restituisce i due capi di una connessione TCP su loopback
+func tcpPair(t testing.TB) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	a, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := <-accepted
+	if b == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a.(*net.TCPConn), b.(*net.TCPConn)
+}
+
+// plainConn nasconde *net.TCPConn per forzare la copia con buffer, mantenendo l'half-close
+type plainConn struct {
+	*net.TCPConn
+}
+
+// relayHarness collega client ↔ pipe ↔ target: pipe riceve i capi interni
+type relayHarness struct {
+	client, local, remote, target net.Conn
+}
+
+func newRelayHarness(t testing.TB, plain bool) relayHarness {
+	client, local := tcpPair(t)
+	remote, target := tcpPair(t)
+	h := relayHarness{client: client, local: local, remote: remote, target: target}
+	if plain {
+		h.local, h.remote = plainConn{local}, plainConn{remote}
+	}
+	return h
+}
+
+func TestPipeCountsBothDirections(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		plain bool
+	}{{"splice", false}, {"buffer", true}} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newRelayHarness(t, tc.plain)
+			up := make([]byte, 3<<20)
+			down := make([]byte, 2<<20+123)
+			rand.Read(up)
+			rand.Read(down)
+
+			var cs ConnStats
+			bs := &BackendStats{}
+			reason := make(chan string, 1)
+			go func() { reason <- pipe(h.local, h.remote, &cs, bs, 0) }()
+
+			// Il client invia e chiude in scrittura, il target risponde dopo aver letto tutto
+			gotUp := make(chan []byte, 1)
+			go func() {
+				b, _ := io.ReadAll(h.target)
+				gotUp <- b
+				h.target.Write(down)
+				h.target.(*net.TCPConn).CloseWrite()
+			}()
+			if _, err := h.client.Write(up); err != nil {
+				t.Fatal(err)
+			}
+			h.client.(*net.TCPConn).CloseWrite()
+			gotDown, err := io.ReadAll(h.client)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case r := <-reason:
+				if r != closeClient {
+					t.Errorf("reason = %s, want %s", r, closeClient)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("pipe did not return")
+			}
+			// Al ritorno di pipe entrambe le direzioni devono essere già contate
+			if n := cs.BytesUp.Load(); n != uint64(len(up)) {
+				t.Errorf("conn bytes up = %d, want %d", n, len(up))
+			}
+			if n := cs.BytesDown.Load(); n != uint64(len(down)) {
+				t.Errorf("conn bytes down = %d, want %d", n, len(down))
+			}
+			if bs.BytesUp.Load() != cs.BytesUp.Load() || bs.BytesDown.Load() != cs.BytesDown.Load() {
+				t.Errorf("backend counters %d/%d differ from connection counters", bs.BytesUp.Load(), bs.BytesDown.Load())
+			}
+			if !bytes.Equal(<-gotUp, up) || !bytes.Equal(gotDown, down) {
+				t.Error("relayed data differs")
+			}
+		})
+	}
+}
+
+func TestPipeTrickleOutlivesIdleTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		plain bool
+	}{{"splice", false}, {"buffer", true}} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			h := newRelayHarness(t, tc.plain)
+			const idle = 1500 * time.Millisecond
+			reason := make(chan string, 1)
+			go func() { reason <- pipe(h.local, h.remote, &ConnStats{}, &BackendStats{}, idle) }()
+			received := make(chan []byte, 1)
+			go func() {
+				b, _ := io.ReadAll(h.target)
+				received <- b
+			}()
+
+			// Qualche byte al secondo, per più del doppio del timeout di inattività
+			for range 4 {
+				if _, err := h.client.Write([]byte("tick")); err != nil {
+					t.Fatal(err)
+				}
+				select {
+				case r := <-reason:
+					t.Fatalf("pipe closed with %s while data was flowing", r)
+				case <-time.After(time.Second):
+				}
+			}
+			h.client.(*net.TCPConn).CloseWrite()
+			h.target.(*net.TCPConn).CloseWrite()
+			if got := <-received; string(got) != "ticktickticktick" {
+				t.Errorf("received %q", got)
+			}
+			if r := <-reason; r == closeIdle {
+				t.Error("closed as idle")
+			}
+		})
+	}
+}
+
+func TestPipeIdleTimeout(t *testing.T) {
+	h := newRelayHarness(t, false)
+	done := make(chan string, 1)
+	go func() { done <- pipe(h.local, h.remote, &ConnStats{}, &BackendStats{}, 300*time.Millisecond) }()
+	select {
+	case r := <-done:
+		if r != closeIdle {
+			t.Errorf("reason = %s, want %s", r, closeIdle)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle connection not closed")
+	}
+}
+
+func TestDialHostUsesCachedAddrs(t *testing.T) {
+	// Il dial non rilegge l'interfaccia: un backend per nome usa gli indirizzi già noti
+	_, port := listenPort(t, "tcp4", "127.0.0.1:0")
+	lb := loopbackBackend(net.IPv4(127, 0, 0, 1), nil)
+	lb.ByInterface, lb.Interface, lb.Bind = true, "dispatch-test0", BindSource
+	c, err := dialHost(context.Background(), lb, net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
+
+// namedBackends crea backend di prova con peso 1
+func namedBackends(names ...string) []*Backend {
+	list := make([]*Backend, len(names))
+	for i, n := range names {
+		list[i] = &Backend{Name: n, ContentionRatio: 1, Stats: &BackendStats{}}
+	}
+	return list
+}
+
+func TestDispatcherRemoveKeepsTurn(t *testing.T) {
+	d := NewDispatcher(namedBackends("a", "b", "c", "d"))
+	d.Next()
+	d.Next() // il prossimo turno è di c
+
+	if got := d.Remove("a", "x"); len(got) != 1 || got[0].Name != "a" {
+		t.Fatalf("Remove returned %v", got)
+	}
+	if lb, _ := d.Next(); lb.Name != "c" {
+		t.Errorf("after removing an earlier backend Next = %s, want c", lb.Name)
+	}
+	d.Remove("d") // era il turno di d: si riparte dal primo
+	if lb, _ := d.Next(); lb.Name != "b" {
+		t.Errorf("after removing the current backend Next = %s, want b", lb.Name)
+	}
+	d.Remove("b", "c")
+	if lb, idx := d.Next(); lb != nil || idx != -1 {
+		t.Errorf("empty dispatcher Next = %v, %d", lb, idx)
+	}
+	if got := d.Healthy(2); len(got) != 0 {
+		t.Errorf("empty dispatcher Healthy = %v", got)
+	}
+}
+
+func TestDispatcherScalesUnhealthyTurn(t *testing.T) {
+	list := namedBackends("a", "b", "c")
+	d := NewDispatcher(list)
+	list[1].Stats.consecutiveFails.Store(unhealthyThreshold)
+
+	pick := func(n int) map[string]int {
+		count := make(map[string]int)
+		for range n {
+			b, _ := d.Next()
+			count[b.Name]++
+		}
+		return count
+	}
+	// Il backend non sano fa da sonda una volta ogni unhealthyProbeTurns giri
+	if got := pick(2 * unhealthyProbeTurns); got["b"] != 1 || got["a"] != unhealthyProbeTurns || got["c"] != unhealthyProbeTurns-1 {
+		t.Errorf("with b unhealthy: %v", got)
+	}
+
+	// Tutti non sani: nessuno è escluso
+	for _, b := range list {
+		b.Stats.consecutiveFails.Store(unhealthyThreshold)
+	}
+	if got := pick(3); got["a"] != 1 || got["b"] != 1 || got["c"] != 1 {
+		t.Errorf("with all unhealthy: %v", got)
+	}
+
+	// Dopo un dial riuscito il backend torna nella rotazione piena
+	for _, b := range list {
+		b.Stats.consecutiveFails.Store(0)
+	}
+	if got := pick(3); got["a"] != 1 || got["b"] != 1 || got["c"] != 1 {
+		t.Errorf("after recovery: %v", got)
+	}
+}
+
+func TestStopKeepsRoutingUntilDrained(t *testing.T) {
+	logger := slog.New(slog.DiscardHandler)
+	var s ProxyServer
+	if err := s.Start("127.0.0.1", 0, false, []string{"127.0.0.1"}, logger); err != nil {
+		t.Fatal(err)
+	}
+	removed := make(chan struct{})
+	s.mu.Lock()
+	s.routing = NewPolicyRouting(logger, false, false)
+	s.routing.applied["test"] = []func() error{func() error { close(removed); return nil }}
+	addr := s.listener.Addr().String()
+	s.mu.Unlock()
+
+	// Una connessione ancora aperta all'arresto tiene le regole
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte{SocksVersion5, 1, socksAuthNone})
+	io.ReadFull(c, make([]byte, 2))
+	s.Stop()
+	select {
+	case <-removed:
+		t.Fatal("routing removed while a connection was still open")
+	case <-time.After(100 * time.Millisecond):
+	}
+	c.Close()
+	select {
+	case <-removed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("routing not removed after the connections drained")
+	}
+}
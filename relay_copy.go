@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	relayBufSize = 32 << 10 // buffer della copia in userspace
+	spliceChunk  = 64 << 10 // byte trasferiti con splice tra un aggiornamento dei contatori e l'altro
+	// spliceTick limita l'attesa di un blocco: un flusso lento aggiorna comunque contatori,
+	// rate e ultima attività, senza scadere per il timeout di inattività
+	spliceTick = 500 * time.Millisecond
+)
+
+// relaySplice abilita splice(2) tra due *net.TCPConn
+const relaySplice = runtime.GOOS == "linux"
+
+// relayBufPool riusa i buffer della copia in userspace tra le connessioni
+var relayBufPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, relayBufSize)
+		return &b
+	},
+}
+
+// writerOnly nasconde ReadFrom, così io.CopyBuffer usa il buffer del pool
+// invece di quello che ReadFrom alloca per ogni chiamata
+type writerOnly struct {
+	io.Writer
+}
+
+// copyCounted copia src in dst aggiornando i contatori della connessione e del backend
+// e l'istante dell'ultima attività (UnixNano) usato per il timeout di inattività.
+// Tra due TCPConn su Linux i dati passano da splice(2) senza attraversare l'userspace,
+// a blocchi di spliceChunk o di spliceTick per tenere aggiornate statistiche e rate;
+// altrimenti si usa un buffer preso dal pool.
+func copyCounted(dst, src net.Conn, conn, backend *atomic.Uint64, active *atomic.Int64) error {
+	if relaySplice {
+		if d, ok := dst.(*net.TCPConn); ok {
+			if s, ok := src.(*net.TCPConn); ok {
+				return spliceCounted(d, s, conn, backend, active)
+			}
+		}
+	}
+	return bufferCounted(dst, src, conn, backend, active)
+}
+
+func bufferCounted(dst, src net.Conn, conn, backend *atomic.Uint64, active *atomic.Int64) error {
+	buf := relayBufPool.Get().(*[]byte)
+	defer relayBufPool.Put(buf)
+	_, err := io.CopyBuffer(writerOnly{dst}, &countingReader{r: src, conn: conn, backend: backend, active: active}, *buf)
+	return err
+}
+
+func spliceCounted(dst, src *net.TCPConn, conn, backend *atomic.Uint64, active *atomic.Int64) error {
+	defer src.SetReadDeadline(time.Time{})
+	lr := &io.LimitedReader{R: src}
+	for {
+		lr.N = spliceChunk
+		src.SetReadDeadline(time.Now().Add(spliceTick))
+		n, err := dst.ReadFrom(lr)
+		if n > 0 {
+			conn.Add(uint64(n))
+			backend.Add(uint64(n))
+			active.Store(time.Now().UnixNano())
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			// Scaduto solo il tick: i byte già passati sono contati, si riprende
+			continue
+		}
+		// Un blocco incompleto senza errore significa EOF
+		if err != nil || n < spliceChunk {
+			return err
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCopyCountedUpdatesBeforeEOF(t *testing.T) {
+	for _, plain := range []bool{false, true} {
+		src, in := tcpPair(t)
+		out, sink := tcpPair(t)
+		go io.Copy(io.Discard, sink)
+		var relayIn, relayOut net.Conn = in, out
+		if plain {
+			relayIn, relayOut = plainConn{in}, plainConn{out}
+		}
+		var conn, backend atomic.Uint64
+		var active atomic.Int64
+		go copyCounted(relayOut, relayIn, &conn, &backend, &active)
+
+		// Pochi byte su una connessione che resta aperta: meno di un blocco di splice
+		src.Write([]byte("hello"))
+		deadline := time.Now().Add(3 * spliceTick)
+		for conn.Load() != 5 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if conn.Load() != 5 || backend.Load() != 5 || active.Load() == 0 {
+			t.Errorf("plain=%v: counters %d/%d, active %d before EOF, want 5 bytes counted", plain, conn.Load(), backend.Load(), active.Load())
+		}
+	}
+}
+
+func benchmarkRelay(b *testing.B, relay func(dst, src *net.TCPConn, conn, backend *atomic.Uint64, active *atomic.Int64) error) {
+	src, in := tcpPair(b)
+	out, sink := tcpPair(b)
+	drained := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, sink)
+		close(drained)
+	}()
+	go func() {
+		var conn, backend atomic.Uint64
+		var active atomic.Int64
+		relay(out, in, &conn, &backend, &active)
+		out.CloseWrite()
+	}()
+
+	chunk := make([]byte, 1<<20)
+	b.SetBytes(int64(len(chunk)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		if _, err := src.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+	src.CloseWrite()
+	<-drained
+}
+
+func BenchmarkRelaySplice(b *testing.B) {
+	if !relaySplice {
+		b.Skip("splice(2) is Linux only")
+	}
+	benchmarkRelay(b, spliceCounted)
+}
+
+func BenchmarkRelayBuffer(b *testing.B) {
+	benchmarkRelay(b, func(dst, src *net.TCPConn, conn, backend *atomic.Uint64, active *atomic.Int64) error {
+		return bufferCounted(dst, src, conn, backend, active)
+	})
+}
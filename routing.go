@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+)
+
+// Destinazioni usate per chiedere al kernel quale interfaccia userebbe una sorgente
+var routeProbes = map[bool]net.IP{
+	false: net.ParseIP("1.1.1.1"),
+	true:  net.ParseIP("2606:4700:4700::1111"),
+}
+
+// RouteCheck è il risultato della verifica di instradamento di un indirizzo sorgente
+type RouteCheck struct {
+	Backend   string `json:"backend"`
+	Interface string `json:"interface"`
+	Bind      string `json:"bind,omitempty"` // modo di binding effettivo
+	Source    string `json:"source"`
+	Probe     string `json:"probe"`
+	Via       string `json:"via,omitempty"` // interfaccia scelta dal kernel
+	Gateway   string `json:"gateway,omitempty"`
+	OK        bool   `json:"ok"`
+	Problem   string `json:"problem,omitempty"`
+}
+
+func (c RouteCheck) String() string {
+	if c.OK {
+		return fmt.Sprintf("%s: from %s via %s OK", c.Backend, c.Source, c.Via)
+	}
+	return fmt.Sprintf("%s: from %s: %s", c.Backend, c.Source, c.Problem)
+}
+
+// routingStep è una modifica di sistema applicata per backend, con le funzioni per annullarla
+type routingStep struct {
+	name    string
+	install func(b *Backend) ([]func() error, error)
+}
+
+// PolicyRouting crea tabelle e regole di routing per sorgente (una tabella per
+// interfaccia) e, se richiesto, gli endpoint MPTCP; ricorda come annullarli, per backend
+type PolicyRouting struct {
+	mu      sync.Mutex
+	log     *slog.Logger
+	steps   []routingStep
+	applied map[string][]func() error
+}
+
+func NewPolicyRouting(logger *slog.Logger, policy, mptcp bool) *PolicyRouting {
+	p := &PolicyRouting{log: logger, applied: make(map[string][]func() error)}
+	if policy {
+		p.steps = append(p.steps, routingStep{"policy routing", installPolicyRouting})
+	}
+	if mptcp {
+		p.steps = append(p.steps, routingStep{"MPTCP endpoints", installMPTCPEndpoints})
+	}
+	return p
+}
+
+// Apply (ri)crea le regole del backend, rimuovendo prima quelle precedenti
+func (p *PolicyRouting) Apply(b *Backend) {
+	if b.Upstream != nil {
+		return
+	}
+	p.Remove(b.Name)
+	var all []func() error
+	for _, step := range p.steps {
+		undo, err := step.install(b)
+		all = append(all, undo...)
+		if err != nil {
+			p.log.Warn(step.name+" failed", "backend", b.Name, "interface", b.Interface, "error", err)
+			continue
+		}
+		if len(undo) > 0 {
+			p.log.Info(step.name+" installed", "backend", b.Name, "interface", b.Interface, "entries", len(undo))
+		}
+	}
+	p.mu.Lock()
+	p.applied[b.Name] = all
+	p.mu.Unlock()
+}
+
+// Remove annulla le regole create per un backend, in ordine inverso
+func (p *PolicyRouting) Remove(name string) {
+	p.mu.Lock()
+	undo := p.applied[name]
+	delete(p.applied, name)
+	p.mu.Unlock()
+	for i := len(undo) - 1; i >= 0; i-- {
+		if err := undo[i](); err != nil {
+			p.log.Warn("policy routing cleanup failed", "backend", name, "error", err)
+		}
+	}
+}
+
+// RemoveAll annulla tutte le modifiche, all'arresto del proxy
+func (p *PolicyRouting) RemoveAll() {
+	p.mu.Lock()
+	names := make([]string, 0, len(p.applied))
+	for name := range p.applied {
+		names = append(names, name)
+	}
+	p.mu.Unlock()
+	for _, name := range names {
+		p.Remove(name)
+	}
+}
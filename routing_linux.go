@@ -0,0 +1,166 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+const (
+	policyTableBase    = 1000  // tabella = base + ifindex, sempre sopra le riservate (253-255)
+	policyRulePriority = 10000 // prima della tabella main (32766)
+)
+
+// policyTable è la tabella di routing dell'interfaccia con quell'indice, usata anche come
+// fwmark nel modo "mark": tabella e mark devono coincidere
+func policyTable(ifindex int) uint32 {
+	return uint32(policyTableBase + ifindex)
+}
+
+// checkRouting chiede al kernel, via netlink, da quale interfaccia uscirebbe il traffico
+// di ogni indirizzo sorgente dei backend, tenendo conto del modo di binding
+func checkRouting(backends []*Backend) []RouteCheck {
+	nl, err := newNLConn()
+	if err != nil {
+		return []RouteCheck{{Problem: err.Error()}}
+	}
+	defer nl.Close()
+
+	var out []RouteCheck
+	for _, b := range backends {
+		mode := b.bindMode()
+		var oif int
+		if mode == BindDevice {
+			if iface, err := net.InterfaceByName(b.Interface); err == nil {
+				oif = iface.Index
+			}
+		}
+		mark, _ := backendMark(b)
+
+		v4, v6 := b.Addrs()
+		for _, src := range []net.IP{v4, v6} {
+			if src == nil {
+				continue
+			}
+			probe := routeProbes[src.To4() == nil]
+			c := RouteCheck{Backend: b.Name, Interface: b.Interface, Bind: string(mode), Source: src.String(), Probe: probe.String()}
+			r, err := nl.routeGet(src, probe, oif, mark)
+			if err != nil {
+				c.Problem = fmt.Sprintf("no route from %s: %v", src, err)
+				out = append(out, c)
+				continue
+			}
+			if iface, err := net.InterfaceByIndex(r.OIF); err == nil {
+				c.Via = iface.Name
+			}
+			if r.Gateway != nil {
+				c.Gateway = r.Gateway.String()
+			}
+			switch {
+			case b.Interface == "":
+				c.Problem = "interface of this address is unknown"
+			case c.Via == b.Interface:
+				c.OK = true
+			case mark != 0 && mode != BindDevice:
+				c.Problem = fmt.Sprintf("traffic marked %#x leaves via %s instead of %s; enable policy routing or add \"ip rule fwmark %#x lookup <table>\"",
+					mark, c.Via, b.Interface, mark)
+			default:
+				c.Problem = fmt.Sprintf("traffic from %s leaves via %s instead of %s; enable policy routing or add \"ip rule from %s lookup <table>\"",
+					src, c.Via, b.Interface, src)
+			}
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// installPolicyRouting crea per ogni famiglia del backend una tabella con la rotta di
+// default dell'interfaccia, una regola "from sorgente" e, nel modo "mark", una regola
+// "fwmark"; restituisce le funzioni per annullarle. Una famiglia senza rotta di default
+// sull'interfaccia si salta: l'errore lo segnala, ma l'altra famiglia viene installata.
+func installPolicyRouting(b *Backend) ([]func() error, error) {
+	if b.Interface == "" {
+		return nil, errors.New("backend has no interface")
+	}
+	iface, err := net.InterfaceByName(b.Interface)
+	if err != nil {
+		return nil, err
+	}
+	nl, err := newNLConn()
+	if err != nil {
+		return nil, err
+	}
+	defer nl.Close()
+
+	table := policyTable(iface.Index)
+	var undo []func() error
+	var skipped error
+	v4, v6 := b.Addrs()
+	for _, src := range []net.IP{v4, v6} {
+		if src == nil {
+			continue
+		}
+		family, _ := ipFamily(src)
+		gw, found, err := nl.defaultGateway(iface.Index, family)
+		if err != nil {
+			return undo, err
+		}
+		if !found {
+			// Una rotta "default dev" senza gateway manderebbe tutto on-link: meglio non
+			// instradare quella famiglia. Per IPv6 è normale e non lo si segnala.
+			if family == syscall.AF_INET {
+				skipped = fmt.Errorf("no IPv4 default route on %s, traffic from %s is not policy-routed", b.Interface, src)
+			}
+			continue
+		}
+
+		switch err := nl.routeAdd(family, table, iface.Index, gw, false); {
+		case err == nil:
+			undo = append(undo, func() error {
+				return withNL(func(c *nlConn) error { return c.routeAdd(family, table, iface.Index, gw, true) })
+			})
+		case errors.Is(err, syscall.EEXIST):
+			// Già presente (creata da altri o da un avvio precedente): non la si rimuove
+		case errors.Is(err, syscall.EPERM):
+			return undo, fmt.Errorf("%w (needs root or CAP_NET_ADMIN)", err)
+		default:
+			return undo, fmt.Errorf("route table %d: %w", table, err)
+		}
+
+		rules := []nlRule{{Family: family, Src: src, Table: table, Priority: policyRulePriority}}
+		if b.bindMode() == BindMark {
+			if mark, err := backendMark(b); err == nil && mark != 0 {
+				rules = append(rules, nlRule{Family: family, Mark: mark, Table: table, Priority: policyRulePriority})
+			}
+		}
+		for _, rule := range rules {
+			switch err := nl.ruleAdd(rule, false); {
+			case err == nil:
+				undo = append(undo, func() error {
+					return withNL(func(c *nlConn) error { return c.ruleAdd(rule, true) })
+				})
+			case errors.Is(err, syscall.EEXIST):
+			default:
+				return undo, fmt.Errorf("rule for %s: %w", src, err)
+			}
+		}
+	}
+	return undo, skipped
+}
+
+// withNL esegue fn su una connessione netlink temporanea; una voce già sparita
+// (ad esempio la rotta tolta dal kernel insieme all'interfaccia) non è un errore
+func withNL(fn func(c *nlConn) error) error {
+	nl, err := newNLConn()
+	if err != nil {
+		return err
+	}
+	defer nl.Close()
+	if err := fn(nl); err != nil && !errors.Is(err, syscall.ESRCH) && !errors.Is(err, syscall.ENOENT) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+//go:build linux
+
+package main
+
+import (
+	"math"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestPolicyTableAvoidsReserved(t *testing.T) {
+	// 0 e le tabelle default (253), main (254) e local (255) del kernel
+	reserved := map[uint32]bool{syscall.RT_TABLE_UNSPEC: true, syscall.RT_TABLE_DEFAULT: true, syscall.RT_TABLE_MAIN: true, syscall.RT_TABLE_LOCAL: true}
+	indexes := []int{math.MaxInt32}
+	for i := 1; i <= 1<<16; i++ {
+		indexes = append(indexes, i)
+	}
+	for _, idx := range indexes {
+		table := policyTable(idx)
+		if table <= syscall.RT_TABLE_LOCAL || reserved[table] {
+			t.Fatalf("ifindex %d gives table %d, reserved by the kernel", idx, table)
+		}
+	}
+}
+
+func TestBackendMarkMatchesPolicyTable(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip(err)
+	}
+	mark, err := backendMark(&Backend{Name: "lo", Interface: "lo", Bind: BindMark})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mark != policyTable(lo.Index) {
+		t.Errorf("mark = %d, want the policy table %d", mark, policyTable(lo.Index))
+	}
+	if mark, _ := backendMark(&Backend{Name: "lo", Interface: "lo", Bind: BindMark, Mark: 0x10}); mark != 0x10 {
+		t.Errorf("configured mark replaced by %d", mark)
+	}
+}
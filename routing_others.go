@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+var errPolicyRoutingUnsupported = errors.New("policy routing is only supported on Linux")
+
+// checkRouting non è disponibile: su Windows e macOS il binding all'IP sorgente basta
+func checkRouting(backends []*Backend) []RouteCheck {
+	return nil
+}
+
+func installPolicyRouting(b *Backend) ([]func() error, error) {
+	return nil, errPolicyRoutingUnsupported
+}
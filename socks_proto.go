@@ -2,10 +2,13 @@ package main
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"math/big"
 	"net"
+	"strconv"
+	"time"
 )
 
 const (
@@ -16,85 +19,294 @@ const (
 	AddrTypeIPv6  = 0x04
 )
 
-func (s *ProxyServer) handleSocks(conn net.Conn) {
-	defer conn.Close()
+// Codici di risposta SOCKS5 (RFC 1928, sezione 6)
+const (
+	socksRepSuccess             = 0x00
+	socksRepGeneralFailure      = 0x01
+	socksRepNotAllowed          = 0x02
+	socksRepNetUnreachable      = 0x03
+	socksRepHostUnreachable     = 0x04
+	socksRepConnRefused         = 0x05
+	socksRepTTLExpired          = 0x06
+	socksRepCmdNotSupported     = 0x07
+	socksRepAddrTypeUnsupported = 0x08
+)
 
-	// 1. Handshake
-	buf := make([]byte, 2)
-	if _, err := io.ReadFull(conn, buf); err != nil {
-		return
+// Tempo concesso al client per ogni fase della negoziazione: oltre, la connessione
+// viene chiusa, così un client lento o muto non trattiene la goroutine
+const (
+	socksGreetingTimeout = 10 * time.Second // versione e metodi di autenticazione
+	socksRequestTimeout  = 10 * time.Second // richiesta CONNECT
+	socksReplyTimeout    = 5 * time.Second  // invio della risposta
+)
+
+var (
+	errSocksVersion  = errors.New("not a SOCKS5 client")
+	errSocksNoMethod = errors.New("no acceptable authentication method")
+)
+
+// socksRequestError è una richiesta rifiutata: rep è il codice da rispondere al client
+type socksRequestError struct {
+	rep    byte
+	reason string
+}
+
+func (e *socksRequestError) Error() string {
+	return e.reason
+}
+
+// readSocksGreeting legge versione e metodi offerti dal client; il proxy accetta
+// solo "nessuna autenticazione" (0x00)
+func readSocksGreeting(r io.Reader) error {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[0] != SocksVersion5 {
+		return errSocksVersion
+	}
+	methods := make([]byte, int(hdr[1]))
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return err
+	}
+	for _, m := range methods {
+		if m == socksAuthNone {
+			return nil
+		}
+	}
+	return errSocksNoMethod
+}
+
+// readSocksRequest legge la richiesta VER CMD RSV ATYP DST.ADDR DST.PORT e restituisce
+// la destinazione host:port; le richieste non valide danno un *socksRequestError
+func readSocksRequest(r io.Reader) (string, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return "", err
+	}
+	if hdr[0] != SocksVersion5 {
+		return "", &socksRequestError{socksRepGeneralFailure, "invalid request version " + strconv.Itoa(int(hdr[0]))}
+	}
+	if hdr[2] != 0x00 {
+		return "", &socksRequestError{socksRepGeneralFailure, "non-zero reserved byte"}
+	}
+	if hdr[1] != CmdConnect {
+		return "", &socksRequestError{socksRepCmdNotSupported, "unsupported command " + strconv.Itoa(int(hdr[1]))}
+	}
+
+	var host string
+	switch hdr[3] {
+	case AddrTypeIPv4, AddrTypeIPv6:
+		ip := make(net.IP, 4)
+		if hdr[3] == AddrTypeIPv6 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case AddrTypeDom:
+		var l [1]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return "", err
+		}
+		dom := make([]byte, int(l[0]))
+		if _, err := io.ReadFull(r, dom); err != nil {
+			return "", err
+		}
+		if !validSocksDomain(dom) {
+			return "", &socksRequestError{socksRepGeneralFailure, "invalid domain name " + strconv.Quote(string(dom))}
+		}
+		host = string(dom)
+	default:
+		return "", &socksRequestError{socksRepAddrTypeUnsupported, "unsupported address type " + strconv.Itoa(int(hdr[3]))}
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
 	}
-	if buf[0] != SocksVersion5 {
+	p := binary.BigEndian.Uint16(port[:])
+	if p == 0 {
+		return "", &socksRequestError{socksRepGeneralFailure, "destination port 0"}
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(p))), nil
+}
+
+// validSocksDomain scarta nomi vuoti o con caratteri che non possono stare in un
+// hostname e confonderebbero log e risoluzione (spazi, controllo, ':' , '/')
+func validSocksDomain(dom []byte) bool {
+	if len(dom) == 0 {
+		return false
+	}
+	for _, c := range dom {
+		if c <= ' ' || c >= 0x7f || c == ':' || c == '/' {
+			return false
+		}
+	}
+	return true
+}
+
+// socksReply invia la risposta con codice rep; BND.ADDR e BND.PORT sono quelli di bnd
+// se è un indirizzo TCP, altrimenti 0.0.0.0:0
+func socksReply(conn net.Conn, rep byte, bnd net.Addr) error {
+	msg := []byte{SocksVersion5, rep, 0}
+	if a, ok := bnd.(*net.TCPAddr); ok && a.IP != nil {
+		if ip4 := a.IP.To4(); ip4 != nil {
+			msg = append(append(msg, AddrTypeIPv4), ip4...)
+		} else {
+			msg = append(append(msg, AddrTypeIPv6), a.IP.To16()...)
+		}
+		msg = binary.BigEndian.AppendUint16(msg, uint16(a.Port))
+	} else {
+		msg = append(msg, AddrTypeIPv4, 0, 0, 0, 0, 0, 0)
+	}
+	conn.SetWriteDeadline(time.Now().Add(socksReplyTimeout))
+	_, err := conn.Write(msg)
+	return err
+}
+
+// socksReplyCode traduce l'errore del dial nel codice di risposta SOCKS5, con la stessa
+// classificazione dell'access log
+func socksReplyCode(err error) byte {
+	switch dialErrorReason(err) {
+	case "refused":
+		return socksRepConnRefused
+	case "network_unreachable":
+		return socksRepNetUnreachable
+	case "host_unreachable", "dns":
+		return socksRepHostUnreachable
+	case "timeout":
+		return socksRepTTLExpired
+	case "permission":
+		return socksRepNotAllowed
+	default:
+		return socksRepGeneralFailure
+	}
+}
+
+// logRejected scrive nell'access log un handshake SOCKS fallito, con la fase e
+// l'eventuale codice REP inviato al client
+func (s *ProxyServer) logRejected(req connRequest, client net.Conn, phase string, err error) {
+	al := s.accessLog.Load()
+	if al == nil {
 		return
 	}
-	methods := make([]byte, int(buf[1]))
-	io.ReadFull(conn, methods)
-	conn.Write([]byte{SocksVersion5, 0x00}) // No Auth
+	rec := AccessRecord{
+		Time:        req.Accepted,
+		ConnID:      req.ID,
+		Client:      client.RemoteAddr().String(),
+		Method:      req.Method,
+		Dest:        req.Dest,
+		Duration:    time.Since(req.Accepted),
+		CloseReason: "rejected",
+		Phase:       phase,
+	}
+	var reqErr *socksRequestError
+	if errors.As(err, &reqErr) {
+		rec.Rep = fmt.Sprintf("0x%02x", reqErr.rep)
+	}
+	al.Log(rec)
+}
 
-	// 2. Request
-	header := make([]byte, 4)
-	if _, err := io.ReadFull(conn, header); err != nil {
+func (s *ProxyServer) handleSocks(conn net.Conn, id uint64) {
+	defer conn.Close()
+	req := connRequest{ID: id, Method: "CONNECT", Accepted: time.Now()}
+	rejected := func(phase string, err error) {
+		if debugEnabled(s.socksLog) {
+			s.socksLog.Debug("handshake failed", "conn", id, "client", conn.RemoteAddr().String(), "phase", phase, "error", err)
+		}
+		s.logRejected(req, conn, phase, err)
+	}
+
+	// 1. Handshake
+	conn.SetDeadline(time.Now().Add(socksGreetingTimeout))
+	if err := readSocksGreeting(conn); err != nil {
+		if err == errSocksNoMethod {
+			conn.Write([]byte{SocksVersion5, socksAuthNoMatch})
+		}
+		rejected("greeting", err)
 		return
 	}
-	if header[1] != CmdConnect {
-		conn.Write([]byte{SocksVersion5, 0x07, 0, 1, 0, 0, 0, 0, 0, 0}) // Cmd not supported
+	if _, err := conn.Write([]byte{SocksVersion5, socksAuthNone}); err != nil {
+		rejected("greeting", err)
 		return
 	}
 
-	var dest string
-	portBuf := make([]byte, 2)
-	switch header[3] {
-	case AddrTypeIPv4:
-		ip := make([]byte, 4)
-		io.ReadFull(conn, ip)
-		io.ReadFull(conn, portBuf)
-		dest = fmt.Sprintf("%s:%d", net.IP(ip).String(), binary.BigEndian.Uint16(portBuf))
-	case AddrTypeDom:
-		l := make([]byte, 1)
-		io.ReadFull(conn, l)
-		dom := make([]byte, int(l[0]))
-		io.ReadFull(conn, dom)
-		io.ReadFull(conn, portBuf)
-		dest = fmt.Sprintf("%s:%d", string(dom), binary.BigEndian.Uint16(portBuf))
-	case AddrTypeIPv6:
-		ip := make([]byte, 16)
-		io.ReadFull(conn, ip)
-		io.ReadFull(conn, portBuf)
-		dest = fmt.Sprintf("[%s]:%d", net.IP(ip).String(), binary.BigEndian.Uint16(portBuf))
+	// 2. Request
+	conn.SetDeadline(time.Now().Add(socksRequestTimeout))
+	dest, err := readSocksRequest(conn)
+	if err != nil {
+		var reqErr *socksRequestError
+		if errors.As(err, &reqErr) {
+			socksReply(conn, reqErr.rep, nil)
+		}
+		rejected("request", err)
+		return
 	}
+	// Il dial ha il suo timeout; il client intanto non deve inviare nulla
+	conn.SetDeadline(time.Time{})
 
 	// 3. Dial Backend
-	remote, lb, idx, err := DialBackend(s.dispatcher, dest)
+	req.Dest = dest
+	dialStart := time.Now()
+	remote, lb, idx, err := DialBackend(s.dispatcher, dest, time.Duration(s.dialRace.Load()))
+	req.DialTime = time.Since(dialStart)
 	if err != nil {
-		s.log(fmt.Sprintf("[WARN] Connect fail %s: %v", dest, err))
-		conn.Write([]byte{SocksVersion5, 0x04, 0, 1, 0, 0, 0, 0, 0, 0}) // Host unreachable
+		s.socksLog.Warn("connect failed", "conn", id, "client", conn.RemoteAddr().String(), "dest", dest, "error", err)
+		backend := ""
+		if lb != nil {
+			backend = lb.Name
+		}
+		s.logDialFailure(req, conn, backend, err)
+		socksReply(conn, socksReplyCode(err), nil)
 		return
 	}
 	
-	s.log(fmt.Sprintf("[DEBUG] SOCKS %s -> %s (via %s LB:%d)", conn.RemoteAddr(), dest, lb.Address, idx))
-	conn.Write([]byte{SocksVersion5, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}) // Success
-	pipe(conn, remote)
+	if debugEnabled(s.socksLog) {
+		s.socksLog.Debug("connect", "conn", id, "client", conn.RemoteAddr().String(), "dest", dest, "backend", lb.Name, "lb", idx)
+	}
+	// BND.ADDR è l'indirizzo locale della connessione del backend (per un proxy a monte,
+	// quello verso il proxy)
+	if err := socksReply(conn, socksRepSuccess, remote.LocalAddr()); err != nil {
+		remote.Close()
+		rejected("reply", err)
+		return
+	}
+	conn.SetWriteDeadline(time.Time{})
+	s.relay(req, conn, remote, lb, idx)
 }
 
-func (s *ProxyServer) handleTunnel(conn net.Conn) {
+func (s *ProxyServer) handleTunnel(conn net.Conn, id uint64) {
 	defer conn.Close()
 	failedBits := big.NewInt(0)
+	req := connRequest{ID: id, Method: "TUNNEL", Accepted: time.Now()}
+	var lastErr error
 	
 	for {
 		lb, idx := s.dispatcher.GetNextFailed(failedBits)
 		if lb == nil {
-			s.log("[WARN] Tunnel: all backends failed")
+			s.tunnelLog.Warn("all backends failed", "conn", id, "client", conn.RemoteAddr().String())
+			if lastErr != nil {
+				s.logDialFailure(req, conn, "", lastErr)
+			}
 			return
 		}
 
-		remote, _, _, err := DialBackend(s.dispatcher, lb.Address) // lb.Address è target in tunnel mode
+		dialStart := time.Now()
+		remote, err := dialTunnel(lb) // lb.Address è target in tunnel mode
+		req.DialTime += time.Since(dialStart)
+		req.Dest = lb.Address
 		if err == nil {
-			s.log(fmt.Sprintf("[DEBUG] Tunnel -> %s (LB:%d)", lb.Address, idx))
-			pipe(conn, remote)
+			if debugEnabled(s.tunnelLog) {
+				s.tunnelLog.Debug("connect", "conn", id, "client", conn.RemoteAddr().String(), "backend", lb.Name, "lb", idx)
+			}
+			s.relay(req, conn, remote, lb, idx)
 			return
 		}
 		
-		s.log(fmt.Sprintf("[WARN] Tunnel fail %s (LB:%d): %v", lb.Address, idx, err))
+		s.tunnelLog.Warn("connect failed", "conn", id, "backend", lb.Name, "lb", idx, "error", err)
+		lastErr = err
 		failedBits.SetBit(failedBits, idx, 1)
 	}
-}
\ No newline at end of file
+}
\ No newline at end of file
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestReadSocksGreeting(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want error // nil = accettato; errFailure = errore di lettura
+	}{
+		{"no auth", []byte{5, 1, 0}, nil},
+		{"no auth among others", []byte{5, 3, 2, 1, 0}, nil},
+		{"password only", []byte{5, 1, 2}, errSocksNoMethod},
+		{"no methods", []byte{5, 0}, errSocksNoMethod},
+		{"socks4", []byte{4, 1, 0}, errSocksVersion},
+		{"truncated methods", []byte{5, 3, 0}, errFailure},
+		{"empty", nil, errFailure},
+	}
+	for _, tt := range tests {
+		err := readSocksGreeting(bytes.NewReader(tt.in))
+		switch {
+		case tt.want == errFailure:
+			if err == nil || errors.Is(err, errSocksNoMethod) || errors.Is(err, errSocksVersion) {
+				t.Errorf("%s: err = %v, want a read error", tt.name, err)
+			}
+		case !errors.Is(err, tt.want):
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+// socksRequest compone una richiesta con comando, tipo di indirizzo, indirizzo e porta
+func socksRequest(cmd, atyp byte, addr []byte, port uint16) []byte {
+	req := append([]byte{SocksVersion5, cmd, 0, atyp}, addr...)
+	return append(req, byte(port>>8), byte(port))
+}
+
+func TestReadSocksRequest(t *testing.T) {
+	dom := func(s string) []byte { return append([]byte{byte(len(s))}, s...) }
+	tests := []struct {
+		name    string
+		in      []byte
+		want    string
+		wantRep int // -1 = nessun *socksRequestError
+	}{
+		{"ipv4", socksRequest(CmdConnect, AddrTypeIPv4, []byte{192, 0, 2, 1}, 443), "192.0.2.1:443", -1},
+		{"ipv6", socksRequest(CmdConnect, AddrTypeIPv6, net.ParseIP("2001:db8::1"), 80), "[2001:db8::1]:80", -1},
+		{"domain", socksRequest(CmdConnect, AddrTypeDom, dom("example.com"), 80), "example.com:80", -1},
+		{"bind", socksRequest(0x02, AddrTypeIPv4, []byte{192, 0, 2, 1}, 80), "", socksRepCmdNotSupported},
+		{"udp associate", socksRequest(0x03, AddrTypeIPv4, []byte{192, 0, 2, 1}, 80), "", socksRepCmdNotSupported},
+		{"unknown address type", socksRequest(CmdConnect, 0x09, []byte{192, 0, 2, 1}, 80), "", socksRepAddrTypeUnsupported},
+		{"version 4", append([]byte{4}, socksRequest(CmdConnect, AddrTypeIPv4, []byte{192, 0, 2, 1}, 80)[1:]...), "", socksRepGeneralFailure},
+		{"reserved byte", []byte{5, CmdConnect, 1, AddrTypeIPv4, 192, 0, 2, 1, 0, 80}, "", socksRepGeneralFailure},
+		{"empty domain", socksRequest(CmdConnect, AddrTypeDom, dom(""), 80), "", socksRepGeneralFailure},
+		{"domain with colon", socksRequest(CmdConnect, AddrTypeDom, dom("a:b"), 80), "", socksRepGeneralFailure},
+		{"port 0", socksRequest(CmdConnect, AddrTypeIPv4, []byte{192, 0, 2, 1}, 0), "", socksRepGeneralFailure},
+		{"truncated address", []byte{5, CmdConnect, 0, AddrTypeIPv6, 0x20, 0x01}, "", -1},
+		{"truncated header", []byte{5, CmdConnect}, "", -1},
+	}
+	for _, tt := range tests {
+		got, err := readSocksRequest(bytes.NewReader(tt.in))
+		var reqErr *socksRequestError
+		switch {
+		case tt.want != "":
+			if err != nil || got != tt.want {
+				t.Errorf("%s: = %q, %v, want %q", tt.name, got, err, tt.want)
+			}
+		case tt.wantRep >= 0:
+			if !errors.As(err, &reqErr) || reqErr.rep != byte(tt.wantRep) {
+				t.Errorf("%s: err = %v, want REP %#x", tt.name, err, tt.wantRep)
+			}
+		default:
+			if err == nil || errors.As(err, &reqErr) {
+				t.Errorf("%s: err = %v, want a read error", tt.name, err)
+			}
+		}
+	}
+}
+
+func FuzzReadSocksGreeting(f *testing.F) {
+	for _, seed := range [][]byte{{5, 1, 0}, {5, 2, 2, 0}, {5, 1, 2}, {5, 0}, {4, 1, 0}, {5, 255}, {}} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if readSocksGreeting(bytes.NewReader(data)) != nil {
+			return
+		}
+		if len(data) < 2 || data[0] != SocksVersion5 || !bytes.Contains(data[2:min(len(data), 2+int(data[1]))], []byte{socksAuthNone}) {
+			t.Errorf("greeting %v accepted without offering no-auth", data)
+		}
+	})
+}
+
+func FuzzReadSocksRequest(f *testing.F) {
+	for _, seed := range [][]byte{
+		socksRequest(CmdConnect, AddrTypeIPv4, []byte{192, 0, 2, 1}, 443),
+		socksRequest(CmdConnect, AddrTypeIPv6, net.ParseIP("2001:db8::1"), 80),
+		socksRequest(CmdConnect, AddrTypeDom, append([]byte{11}, "example.com"...), 80),
+		socksRequest(0x02, AddrTypeIPv4, []byte{192, 0, 2, 1}, 80),
+		socksRequest(CmdConnect, 0x09, nil, 80),
+		socksRequest(CmdConnect, AddrTypeDom, []byte{3, 'a', ':', 'b'}, 80),
+		socksRequest(CmdConnect, AddrTypeIPv4, []byte{192, 0, 2, 1}, 0),
+		{5, CmdConnect, 0, AddrTypeDom, 200, 'x'},
+		{4, CmdConnect, 0},
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		dest, err := readSocksRequest(bytes.NewReader(data))
+		var reqErr *socksRequestError
+		if errors.As(err, &reqErr) {
+			switch reqErr.rep {
+			case socksRepGeneralFailure, socksRepCmdNotSupported, socksRepAddrTypeUnsupported:
+			default:
+				t.Errorf("unexpected REP %#x for %v", reqErr.rep, data)
+			}
+			return
+		}
+		if err != nil {
+			return
+		}
+		host, port, err := net.SplitHostPort(dest)
+		if err != nil {
+			t.Fatalf("destination %q: %v", dest, err)
+		}
+		if p, _ := strconv.Atoi(port); host == "" || p == 0 {
+			t.Errorf("destination %q accepted from %v", dest, data)
+		}
+	})
+}
+
+func TestHandleSocksLogsRejected(t *testing.T) {
+	tests := []struct {
+		name      string
+		send      []byte
+		wantPhase string
+		wantRep   string
+	}{
+		{"no acceptable method", []byte{5, 1, 2}, "greeting", ""},
+		{"unsupported command", []byte{5, 1, 0, 5, 2, 0, 1, 127, 0, 0, 1, 0, 80}, "request", "0x07"},
+		{"unsupported address type", []byte{5, 1, 0, 5, 1, 0, 9, 127, 0, 0, 1, 0, 80}, "request", "0x08"},
+		{"bad request version", []byte{5, 1, 0, 4, 1, 0, 1, 127, 0, 0, 1, 0, 80}, "request", "0x01"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			al, _ := NewAccessLogger(nopWriteCloser{&out}, "json")
+			s := &ProxyServer{socksLog: slog.New(slog.DiscardHandler)}
+			s.accessLog.Store(al)
+
+			client, server := tcpPair(t)
+			done := make(chan struct{})
+			go func() {
+				s.handleSocks(server, 7)
+				close(done)
+			}()
+			client.Write(tt.send)
+			client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			io.Copy(io.Discard, client)
+			<-done
+
+			var rec struct {
+				Conn        uint64 `json:"conn"`
+				CloseReason string `json:"close_reason"`
+				Phase       string `json:"phase"`
+				Rep         string `json:"rep"`
+			}
+			if err := json.Unmarshal(out.Bytes(), &rec); err != nil {
+				t.Fatalf("access log %q: %v", out.String(), err)
+			}
+			if rec.Conn != 7 || rec.CloseReason != "rejected" || rec.Phase != tt.wantPhase || rec.Rep != tt.wantRep {
+				t.Errorf("record = %+v, want phase %q rep %q", rec, tt.wantPhase, tt.wantRep)
+			}
+		})
+	}
+}
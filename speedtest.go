@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Destinazione di default del test di velocità; con speedtest-server si può usare
+// un server locale, es. http://192.168.1.10:8081/
+const (
+	defaultSpeedTestURL       = "https://speed.cloudflare.com/__down?bytes=1000000000"
+	defaultSpeedTestUploadURL = "https://speed.cloudflare.com/__up"
+	defaultSpeedTestDuration  = 8 * time.Second
+	speedTestPings            = 3 // connessioni TCP per la misura della latenza, vale la minima
+)
+
+// SpeedTestConfig indica dove misurare: GET su URL per il download, POST su UploadURL
+// (URL se vuoto) per l'upload, ciascuno per Duration
+type SpeedTestConfig struct {
+	URL       string
+	UploadURL string
+	Duration  time.Duration
+}
+
+// SpeedResult è l'esito del test di un backend; Weight è il peso suggerito
+// rispetto all'interfaccia più veloce misurata finora
+type SpeedResult struct {
+	Backend  string  `json:"backend"`
+	RTTMs    float64 `json:"rtt_ms"` // connessione TCP più rapida tra speedTestPings
+	DownMbps float64 `json:"down_mbps"`
+	UpMbps   float64 `json:"up_mbps"`
+	Weight   int     `json:"weight"`
+}
+
+func (r SpeedResult) String() string {
+	return fmt.Sprintf("%s: connect %.1f ms, down %.1f Mb/s, up %.1f Mb/s", r.Backend, r.RTTMs, r.DownMbps, r.UpMbps)
+}
+
+// runSpeedTest misura latenza di connessione, download e upload attraverso lb, con lo
+// stesso dial legato all'interfaccia usato per le connessioni dei client
+func runSpeedTest(ctx context.Context, lb *Backend, cfg SpeedTestConfig) (SpeedResult, error) {
+	res := SpeedResult{Backend: lb.Name}
+	if cfg.UploadURL == "" {
+		cfg.UploadURL = cfg.URL
+	}
+	if cfg.Duration <= 0 {
+		cfg.Duration = defaultSpeedTestDuration
+	}
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return res, err
+	}
+	port := map[string]string{"http": "80", "https": "443"}[u.Scheme]
+	if port == "" || u.Hostname() == "" {
+		return res, fmt.Errorf("speed test URL %q: want http:// or https://", cfg.URL)
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+	addr := net.JoinHostPort(u.Hostname(), port)
+
+	var best time.Duration
+	for range speedTestPings {
+		start := time.Now()
+		c, err := dialVia(ctx, lb, addr)
+		if err != nil {
+			return res, fmt.Errorf("connect %s: %w", addr, err)
+		}
+		rtt := time.Since(start)
+		c.Close()
+		if best == 0 || rtt < best {
+			best = rtt
+		}
+	}
+	res.RTTMs = float64(best) / float64(time.Millisecond)
+
+	tr := backendTransport(lb)
+	defer tr.CloseIdleConnections()
+	client := &http.Client{Transport: tr}
+
+	if res.DownMbps, err = speedDownload(ctx, client, cfg.URL, cfg.Duration); err != nil {
+		return res, fmt.Errorf("download: %w", err)
+	}
+	if res.UpMbps, err = speedUpload(ctx, client, cfg.UploadURL, cfg.Duration); err != nil {
+		return res, fmt.Errorf("upload: %w", err)
+	}
+	return res, nil
+}
+
+// backendTransport è un client HTTP(S) le cui connessioni escono da lb, come quelle dei client
+// del proxy; la compressione è disattivata perché interessano i byte sul collegamento
+func backendTransport(lb *Backend) *http.Transport {
+	return &http.Transport{
+		DialContext: func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return dialVia(ctx, lb, addr)
+		},
+		DisableCompression:    true,
+		TLSHandshakeTimeout:   backendDialTimeout,
+		ResponseHeaderTimeout: backendDialTimeout,
+	}
+}
+
+// speedDownload legge la risposta di un GET per al massimo d, dal primo byte ricevuto
+func speedDownload(ctx context.Context, client *http.Client, rawURL string, d time.Duration) (float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, d+backendDialTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("server replied %s", resp.Status)
+	}
+
+	buf := make([]byte, relayBufSize)
+	var n int64
+	start := time.Now()
+	for time.Since(start) < d {
+		m, err := resp.Body.Read(buf)
+		n += int64(m)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return mbps(n, time.Since(start)), nil
+}
+
+// speedUpload invia un POST di durata d e attende la risposta del server
+func speedUpload(ctx context.Context, client *http.Client, rawURL string, d time.Duration) (float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, d+backendDialTimeout)
+	defer cancel()
+	body := &timedReader{d: d, buf: make([]byte, relayBufSize)}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rawURL, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return 0, fmt.Errorf("server replied %s", resp.Status)
+	}
+	return mbps(body.n, time.Since(body.start)), nil
+}
+
+// timedReader produce dati per d a partire dalla prima lettura, poi EOF
+type timedReader struct {
+	d     time.Duration
+	buf   []byte
+	start time.Time
+	n     int64
+}
+
+func (t *timedReader) Read(p []byte) (int, error) {
+	if t.start.IsZero() {
+		t.start = time.Now()
+	} else if time.Since(t.start) >= t.d {
+		return 0, io.EOF
+	}
+	n := copy(p, t.buf)
+	t.n += int64(n)
+	return n, nil
+}
+
+func mbps(n int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(n) * 8 / d.Seconds() / 1e6
+}
+
+// speedWeight converte il download misurato in un peso da 1 a maxWeight,
+// proporzionale all'interfaccia più veloce (best)
+func speedWeight(down, best float64) int {
+	if best <= 0 {
+		return 1
+	}
+	return min(max(int(math.Round(maxWeight*down/best)), 1), maxWeight)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Dati inviati da una GET senza ?bytes=: più di quanto serva a qualsiasi test
+const speedTestServerBytes = 100 << 30
+
+// runSpeedTestServer avvia un server per il test di velocità senza Internet: una GET
+// scarica ?bytes=N byte (casuali, non comprimibili), una POST scarta il corpo ricevuto
+func runSpeedTestServer(args []string) error {
+	fs := flag.NewFlagSet("speedtest-server", flag.ContinueOnError)
+	listen := fs.String("listen", ":8081", "address to listen on")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("speed test server on http://%s/ (GET downloads, POST uploads)\n", l.Addr())
+	fmt.Printf("use it with: dispatch-proxy -speedtest-url http://<this host>:%d/\n", l.Addr().(*net.TCPAddr).Port)
+
+	chunk := make([]byte, 1<<20)
+	rand.Read(chunk)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			size := int64(speedTestServerBytes)
+			if v := r.URL.Query().Get("bytes"); v != "" {
+				n, err := strconv.ParseInt(v, 10, 64)
+				if err != nil || n < 0 {
+					http.Error(w, "invalid bytes", http.StatusBadRequest)
+					return
+				}
+				size = n
+			}
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+			for left := size; left > 0; {
+				n, err := w.Write(chunk[:min(left, int64(len(chunk)))])
+				if err != nil {
+					return
+				}
+				left -= int64(n)
+			}
+		case http.MethodPost:
+			n, _ := io.Copy(io.Discard, r.Body)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]int64{"bytes": n})
+		default:
+			http.Error(w, "use GET or POST", http.StatusMethodNotAllowed)
+		}
+	}), ReadHeaderTimeout: 5 * time.Second}
+	return srv.Serve(l)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSpeedWeight(t *testing.T) {
+	tests := []struct {
+		down, best float64
+		want       int
+	}{
+		{50, 0, 1}, // nessun riferimento
+		{100, 100, maxWeight},
+		{50, 100, 2},
+		{30, 100, 1},
+		{0, 100, 1},
+		{200, 100, maxWeight}, // più veloce del riferimento: limitato
+	}
+	for _, tt := range tests {
+		if got := speedWeight(tt.down, tt.best); got != tt.want {
+			t.Errorf("speedWeight(%v, %v) = %d, want %d", tt.down, tt.best, got, tt.want)
+		}
+	}
+}
+
+func TestTimedReader(t *testing.T) {
+	const d = 100 * time.Millisecond
+	r := &timedReader{d: d, buf: make([]byte, 1000)}
+	p := make([]byte, 4096)
+	var total int64
+	for {
+		n, err := r.Read(p)
+		if n > len(r.buf) {
+			t.Fatalf("read %d bytes, more than the buffer", n)
+		}
+		total += int64(n)
+		if err == io.EOF {
+			break
+		}
+	}
+	elapsed := time.Since(r.start)
+	if elapsed < d || elapsed > d+500*time.Millisecond {
+		t.Errorf("stopped after %v, want about %v", elapsed, d)
+	}
+	if r.n != total || total == 0 {
+		t.Errorf("counted %d bytes, read %d", r.n, total)
+	}
+	if n, err := r.Read(p); n != 0 || err != io.EOF {
+		t.Errorf("read after EOF = %d, %v", n, err)
+	}
+	if got := mbps(total, elapsed); got <= 0 {
+		t.Errorf("mbps = %v", got)
+	}
+	if got := mbps(1e6, time.Second); got != 8 {
+		t.Errorf("mbps(1 MB, 1 s) = %v, want 8", got)
+	}
+}
+
+// speedServer serve download senza fine su /down e conta i byte ricevuti su /up
+func speedServer(t *testing.T) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	var uploaded atomic.Int64
+	chunk := make([]byte, 64<<10)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /down", func(w http.ResponseWriter, r *http.Request) {
+		for r.Context().Err() == nil {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	})
+	mux.HandleFunc("POST /up", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := io.Copy(io.Discard, r.Body)
+		uploaded.Add(n)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv, &uploaded
+}
+
+func speedBackend() *Backend {
+	lb := loopbackBackend(net.IPv4(127, 0, 0, 1), nil)
+	lb.Stats = NewMetricsRegistry().Backend(lb.Name, "lo")
+	return lb
+}
+
+func TestRunSpeedTest(t *testing.T) {
+	srv, uploaded := speedServer(t)
+	cfg := SpeedTestConfig{URL: srv.URL + "/down", UploadURL: srv.URL + "/up", Duration: 200 * time.Millisecond}
+	res, err := runSpeedTest(context.Background(), speedBackend(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Backend != "lo" || res.RTTMs <= 0 || res.RTTMs > 1000 {
+		t.Errorf("result %+v: want the backend name and a loopback RTT", res)
+	}
+	if res.DownMbps <= 0 || res.UpMbps <= 0 {
+		t.Errorf("result %+v: want download and upload measured", res)
+	}
+	if uploaded.Load() == 0 {
+		t.Error("server received no upload")
+	}
+}
+
+func TestRunSpeedTestErrors(t *testing.T) {
+	srv, _ := speedServer(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := "http://" + l.Addr().String() + "/down"
+	l.Close()
+
+	tests := []struct {
+		name string
+		cfg  SpeedTestConfig
+		want string
+	}{
+		{"backend cannot dial", SpeedTestConfig{URL: closed}, "connect"},
+		{"unsupported scheme", SpeedTestConfig{URL: "ftp://127.0.0.1/file"}, "want http"},
+		{"download not found", SpeedTestConfig{URL: srv.URL + "/missing", UploadURL: srv.URL + "/up"}, "download"},
+		{"upload not allowed", SpeedTestConfig{URL: srv.URL + "/down", UploadURL: srv.URL + "/down", Duration: 50 * time.Millisecond}, "upload"},
+	}
+	for _, tt := range tests {
+		res, err := runSpeedTest(context.Background(), speedBackend(), tt.cfg)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: err = %v, want it to mention %q", tt.name, err, tt.want)
+		}
+		// Le misure già fatte restano nel risultato, quelle fallite no
+		if res.UpMbps != 0 || tt.want != "upload" && res.DownMbps != 0 {
+			t.Errorf("%s: result %+v reports a failed measure", tt.name, res)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// ConnStats contiene i contatori di traffico di una singola connessione inoltrata
+type ConnStats struct {
+	BytesUp   atomic.Uint64
+	BytesDown atomic.Uint64
+}
+
+// countingReader conta i byte letti aggiornando sia la connessione che il backend;
+// active, se presente, riceve l'istante (UnixNano) dell'ultima lettura
+type countingReader struct {
+	r       io.Reader
+	conn    *atomic.Uint64
+	backend *atomic.Uint64
+	active  *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if n > 0 {
+		c.conn.Add(uint64(n))
+		c.backend.Add(uint64(n))
+		if c.active != nil {
+			c.active.Store(time.Now().UnixNano())
+		}
+	}
+	return n, err
+}
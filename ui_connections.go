@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+const allBackends = "All backends"
+
+// Colonne della tabella connessioni: titolo, chiave di ordinamento (vedi SortConns) e larghezza
+var connColumns = []struct {
+	title string
+	key   string
+	width float32
+}{
+	{"ID", "id", 60},
+	{"Client", "client", 150},
+	{"Destination", "dest", 220},
+	{"Remote IP", "remote", 130},
+	{"MPTCP", "mptcp", 60},
+	{"Backend (LB)", "backend", 150},
+	{"Started", "start", 90},
+	{"Up", "up", 90},
+	{"Down", "down", 90},
+	{"Rate Up", "rate_up", 110},
+	{"Rate Down", "rate_down", 110},
+}
+
+func connCell(c ConnSnapshot, col int) string {
+	switch connColumns[col].key {
+	case "id":
+		return fmt.Sprintf("%d", c.ID)
+	case "client":
+		return c.Client
+	case "dest":
+		return c.Dest
+	case "remote":
+		return c.RemoteIP
+	case "mptcp":
+		if c.MPTCP {
+			return "yes"
+		}
+		return ""
+	case "backend":
+		return fmt.Sprintf("%s (%d)", c.Backend, c.LBIndex)
+	case "start":
+		return c.Start.Format("15:04:05")
+	case "up":
+		return formatBytes(c.BytesUp)
+	case "down":
+		return formatBytes(c.BytesDown)
+	case "rate_up":
+		return fmt.Sprintf("%.2f Mb/s", float64(c.RateUp)*8/1_000_000)
+	case "rate_down":
+		return fmt.Sprintf("%.2f Mb/s", float64(c.RateDown)*8/1_000_000)
+	}
+	return ""
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// newConnectionsTab costruisce la tab delle connessioni attive.
+// Restituisce il contenuto e la funzione di aggiornamento da chiamare periodicamente.
+func newConnectionsTab(w fyne.Window, p *ProxyServer, logger *slog.Logger) (fyne.CanvasObject, func()) {
+	var rows []ConnSnapshot
+	var selectedID uint64
+	sortKey, sortDesc := "id", false
+
+	filterEntry := widget.NewEntry()
+	filterEntry.SetPlaceHolder("Filter by client, destination or IP...")
+	backendSelect := widget.NewSelect([]string{allBackends}, nil)
+	backendSelect.SetSelected(allBackends)
+	countLbl := widget.NewLabel("0 connections")
+
+	table := widget.NewTable(
+		func() (int, int) { return len(rows), len(connColumns) },
+		func() fyne.CanvasObject {
+			l := widget.NewLabel("")
+			l.Truncation = fyne.TextTruncateEllipsis
+			return l
+		},
+		func(id widget.TableCellID, o fyne.CanvasObject) {
+			if id.Row < len(rows) {
+				o.(*widget.Label).SetText(connCell(rows[id.Row], id.Col))
+			}
+		},
+	)
+	for i, c := range connColumns {
+		table.SetColumnWidth(i, c.width)
+	}
+
+	var update func()
+
+	// Header cliccabili per l'ordinamento
+	table.ShowHeaderRow = true
+	table.CreateHeader = func() fyne.CanvasObject {
+		return widget.NewButton("", nil)
+	}
+	table.UpdateHeader = func(id widget.TableCellID, o fyne.CanvasObject) {
+		col := connColumns[id.Col]
+		title := col.title
+		if col.key == sortKey {
+			if sortDesc {
+				title += " ▼"
+			} else {
+				title += " ▲"
+			}
+		}
+		b := o.(*widget.Button)
+		b.SetText(title)
+		b.OnTapped = func() {
+			if sortKey == col.key {
+				sortDesc = !sortDesc
+			} else {
+				sortKey, sortDesc = col.key, false
+			}
+			update()
+		}
+	}
+	table.OnSelected = func(id widget.TableCellID) {
+		if id.Row >= 0 && id.Row < len(rows) {
+			selectedID = rows[id.Row].ID
+		}
+	}
+
+	// update va eseguita sul thread della GUI
+	update = func() {
+		all := p.Connections().Snapshot()
+
+		// Opzioni del filtro backend dalle connessioni attive
+		seen := map[string]bool{}
+		options := []string{allBackends}
+		for _, c := range all {
+			if !seen[c.Backend] {
+				seen[c.Backend] = true
+				options = append(options, c.Backend)
+			}
+		}
+		sort.Strings(options[1:])
+		backendSelect.Options = options
+
+		backend := backendSelect.Selected
+		if backend == allBackends {
+			backend = ""
+		}
+		rows = FilterConns(all, filterEntry.Text, backend)
+		SortConns(rows, sortKey, sortDesc)
+		countLbl.SetText(fmt.Sprintf("%d of %d connections", len(rows), len(all)))
+		table.Refresh()
+	}
+	filterEntry.OnChanged = func(string) { update() }
+	backendSelect.OnChanged = func(string) { update() }
+
+	closeSelectedBtn := widget.NewButton("Close Selected", func() {
+		if selectedID == 0 {
+			return
+		}
+		if p.Connections().Close(selectedID) {
+			logger.Info("connection closed by user", "conn", selectedID)
+		}
+		selectedID = 0
+		table.UnselectAll()
+		update()
+	})
+	closeBackendBtn := widget.NewButton("Close All on Backend", func() {
+		backend := backendSelect.Selected
+		if backend == "" || backend == allBackends {
+			dialog.ShowInformation("Close connections", "Select a backend first", w)
+			return
+		}
+		dialog.ShowConfirm("Close connections",
+			fmt.Sprintf("Close every connection on %s?", backend),
+			func(ok bool) {
+				if !ok {
+					return
+				}
+				n := p.Connections().CloseBackend(backend)
+				logger.Info("backend connections closed by user", "backend", backend, "count", n)
+				update()
+			}, w)
+	})
+	closeBackendBtn.Importance = widget.DangerImportance
+
+	top := container.NewBorder(nil, nil, nil, backendSelect, filterEntry)
+	bottom := container.NewHBox(countLbl, widget.NewSeparator(), closeSelectedBtn, closeBackendBtn)
+	return container.NewBorder(top, bottom, nil, nil, table), update
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"log/slog"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// Righe conservate dal visualizzatore log della GUI
+const maxLogEntries = 5000
+
+var logLevelNames = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+func levelColor(l slog.Level) color.Color {
+	switch {
+	case l >= slog.LevelError:
+		return color.RGBA{255, 80, 80, 255}
+	case l >= slog.LevelWarn:
+		return color.RGBA{255, 191, 0, 255}
+	case l >= slog.LevelInfo:
+		return color.RGBA{0, 255, 65, 255} // Verde Matrix
+	default:
+		return color.RGBA{150, 150, 150, 255}
+	}
+}
+
+// newLogView costruisce il visualizzatore dei log (lista virtualizzata su buffer circolare).
+// Restituisce il contenuto, la barra dei comandi e il sink da registrare sul LogRouter;
+// il ridisegno periodico termina alla chiusura di done.
+func newLogView(w fyne.Window, done <-chan struct{}) (fyne.CanvasObject, fyne.CanvasObject, func(LogEntry)) {
+	ring := NewLogRing(maxLogEntries)
+	var view []LogEntry
+
+	levelSelect := widget.NewSelect(logLevelNames, nil)
+	levelSelect.SetSelected("DEBUG")
+	backendSelect := widget.NewSelect([]string{allBackends}, nil)
+	backendSelect.SetSelected(allBackends)
+	searchEntry := widget.NewEntry()
+	searchEntry.SetPlaceHolder("Search logs...")
+	pauseCheck := widget.NewCheck("Pause", nil)
+
+	list := widget.NewList(
+		func() int { return len(view) },
+		func() fyne.CanvasObject {
+			t := canvas.NewText("", levelColor(slog.LevelInfo))
+			t.TextStyle = fyne.TextStyle{Monospace: true}
+			return t
+		},
+		func(id widget.ListItemID, o fyne.CanvasObject) {
+			if id >= len(view) {
+				return
+			}
+			t := o.(*canvas.Text)
+			t.Text = view[id].String()
+			t.Color = levelColor(view[id].Level)
+			t.Refresh()
+		},
+	)
+
+	currentFilter := func() LogFilter {
+		var f LogFilter
+		f.MinLevel.UnmarshalText([]byte(levelSelect.Selected))
+		if backendSelect.Selected != allBackends {
+			f.Backend = backendSelect.Selected
+		}
+		f.Text = searchEntry.Text
+		return f
+	}
+
+	// refresh va eseguita sul thread della GUI; con force ridisegna anche senza novità.
+	// La pausa ferma solo lo scorrimento automatico: filtri e nuove righe restano attivi.
+	var lastSeq uint64
+	refresh := func(force bool) {
+		seq := ring.Seq()
+		if !force && seq == lastSeq {
+			return
+		}
+		lastSeq = seq
+		view = ring.Filter(currentFilter())
+		backendSelect.Options = append([]string{allBackends}, ring.Backends()...)
+		list.Refresh()
+		if !pauseCheck.Checked {
+			list.ScrollToBottom()
+		}
+	}
+	levelSelect.OnChanged = func(string) { refresh(true) }
+	backendSelect.OnChanged = func(string) { refresh(true) }
+	searchEntry.OnChanged = func(string) { refresh(true) }
+	pauseCheck.OnChanged = func(paused bool) {
+		if !paused {
+			list.ScrollToBottom()
+		}
+	}
+
+	// Ridisegno a intervalli fissi: nessun lavoro GUI per singola riga di log
+	go func() {
+		ticker := time.NewTicker(250 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fyne.Do(func() { refresh(false) })
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	clearBtn := widget.NewButton("Clear", func() {
+		ring.Clear()
+		refresh(true)
+	})
+	clearBtn.Importance = widget.LowImportance
+
+	exportBtn := widget.NewButton("Export...", func() {
+		lines := append([]LogEntry(nil), view...)
+		dialog.ShowFileSave(func(wc fyne.URIWriteCloser, err error) {
+			if err != nil {
+				dialog.ShowError(err, w)
+				return
+			}
+			if wc == nil {
+				return
+			}
+			defer wc.Close()
+			for _, e := range lines {
+				if _, err := fmt.Fprintln(wc, e.String()); err != nil {
+					dialog.ShowError(err, w)
+					return
+				}
+			}
+		}, w)
+	})
+	exportBtn.Importance = widget.LowImportance
+
+	toolbar := container.NewBorder(nil, nil,
+		container.NewHBox(levelSelect, backendSelect),
+		container.NewHBox(pauseCheck, exportBtn, clearBtn),
+		searchEntry,
+	)
+	return list, toolbar, ring.Append
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"runtime"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/widget"
+)
+
+// showRoutingChecks mostra il risultato della verifica di instradamento dei backend
+func showRoutingChecks(checks []RouteCheck, w fyne.Window) {
+	if len(checks) == 0 {
+		msg := "No backend to check: select at least one interface in SOCKS mode."
+		if runtime.GOOS != "linux" {
+			msg = "The routing check is only available on Linux."
+		}
+		dialog.ShowInformation("Routing", msg, w)
+		return
+	}
+
+	var b strings.Builder
+	failed := 0
+	for _, c := range checks {
+		mark := "✓ "
+		if !c.OK {
+			mark = "✗ "
+			failed++
+		}
+		b.WriteString(mark + c.String() + "\n")
+	}
+	if failed > 0 {
+		b.WriteString("\nStart with -policy-routing (as root or with CAP_NET_ADMIN) to create per-interface routing tables.")
+	}
+
+	text := widget.NewLabel(b.String())
+	text.Wrapping = fyne.TextWrapWord
+	scroll := container.NewVScroll(text)
+	scroll.SetMinSize(fyne.NewSize(560, 240))
+	dialog.ShowCustom("Routing", "Close", scroll, w)
+}
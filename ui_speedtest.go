@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+)
+
+// showSpeedResult mostra l'esito del test di un'interfaccia e propone il peso suggerito
+func showSpeedResult(ctrl *Controller, name string, res SpeedResult, err error, w fyne.Window) {
+	if err != nil {
+		dialog.ShowError(fmt.Errorf("speed test of %s failed: %w", name, err), w)
+		return
+	}
+	var current IfaceConfig
+	for _, ic := range ctrl.Interfaces() {
+		if ic.Name == name {
+			current = ic
+		}
+	}
+	msg := fmt.Sprintf("Connect time: %.1f ms\nDownload: %.1f Mb/s\nUpload: %.1f Mb/s\n\nSuggested weight: %d (current %d), relative to the fastest interface tested so far.",
+		res.RTTMs, res.DownMbps, res.UpMbps, res.Weight, current.Weight)
+	if current.Name == "" || res.Weight == current.Weight {
+		dialog.ShowInformation("Speed Test: "+name, msg, w)
+		return
+	}
+	d := dialog.NewConfirm("Speed Test: "+name, msg, func(apply bool) {
+		if apply {
+			if err := ctrl.SetInterface(name, current.Enabled, res.Weight); err != nil {
+				dialog.ShowError(err, w)
+			}
+		}
+	}, w)
+	d.SetConfirmText("Apply Weight")
+	d.SetDismissText("Close")
+	d.Show()
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Metodi di autenticazione SOCKS5 (RFC 1928, RFC 1929)
+const (
+	socksAuthNone     = 0x00
+	socksAuthPassword = 0x02
+	socksAuthNoMatch  = 0xff
+)
+
+// parseUpstream valida l'URL di un proxy a monte: socks5://, socks5h://, http:// o https://,
+// con credenziali facoltative, oppure bond:// per un relay del bonding; la porta di default
+// è quella del protocollo
+func parseUpstream(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	port := ""
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		port = "1080"
+	case "http":
+		port = "8080"
+	case "https":
+		port = "443"
+	case "bond":
+		port = bondDefaultPort
+	default:
+		return nil, fmt.Errorf("upstream %s: unsupported scheme %q (want socks5, http, https or bond)", u.Redacted(), u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("upstream %s: missing host", u.Redacted())
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u, nil
+}
+
+// upstreamName identifica il backend senza esporre la password in GUI, log e metriche
+func upstreamName(u *url.URL) string {
+	n := &url.URL{Scheme: u.Scheme, Host: u.Host}
+	if u.User != nil && u.User.Username() != "" {
+		n.User = url.User(u.User.Username())
+	}
+	return n.String()
+}
+
+// dialUpstream apre la connessione verso remoteAddr attraverso il proxy a monte del backend;
+// i nomi a dominio sono passati al proxy, che li risolve dal suo lato
+func dialUpstream(ctx context.Context, lb *Backend, remoteAddr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, backendDialTimeout)
+	defer cancel()
+
+	u := lb.Upstream
+	d := net.Dialer{Timeout: backendDialTimeout, KeepAlive: keepAlivePeriod(lb.keepAlive), KeepAliveConfig: lb.keepAlive}
+	c, err := d.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "https" {
+		tc := tls.Client(c, &tls.Config{ServerName: u.Hostname()})
+		if err := tc.HandshakeContext(ctx); err != nil {
+			c.Close()
+			return nil, err
+		}
+		c = tc
+	}
+
+	// La negoziazione rispetta lo stesso timeout del dial
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		err = socks5Connect(c, u.User, remoteAddr)
+	default:
+		c, err = httpConnect(c, u, remoteAddr)
+	}
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("upstream %s: %w", lb.Name, err)
+	}
+	c.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// socks5Connect esegue handshake, autenticazione e CONNECT su un proxy SOCKS5
+func socks5Connect(c net.Conn, user *url.Userinfo, remoteAddr string) error {
+	host, portStr, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+
+	methods := []byte{socksAuthNone}
+	if user != nil {
+		methods = []byte{socksAuthPassword, socksAuthNone}
+	}
+	if _, err := c.Write(append([]byte{SocksVersion5, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	var sel [2]byte
+	if _, err := io.ReadFull(c, sel[:]); err != nil {
+		return err
+	}
+	if sel[0] != SocksVersion5 {
+		return fmt.Errorf("not a SOCKS5 proxy (version %d)", sel[0])
+	}
+	switch sel[1] {
+	case socksAuthNone:
+	case socksAuthPassword:
+		if user == nil {
+			return errors.New("proxy requires a username and password")
+		}
+		name := user.Username()
+		pass, _ := user.Password()
+		if len(name) > 255 || len(pass) > 255 {
+			return errors.New("username or password too long")
+		}
+		msg := []byte{0x01, byte(len(name))}
+		msg = append(msg, name...)
+		msg = append(msg, byte(len(pass)))
+		msg = append(msg, pass...)
+		if _, err := c.Write(msg); err != nil {
+			return err
+		}
+		var st [2]byte
+		if _, err := io.ReadFull(c, st[:]); err != nil {
+			return err
+		}
+		if st[1] != 0x00 {
+			return errors.New("authentication failed")
+		}
+	case socksAuthNoMatch:
+		return errors.New("no acceptable authentication method")
+	default:
+		return fmt.Errorf("unexpected authentication method %#x", sel[1])
+	}
+
+	req := []byte{SocksVersion5, CmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("host name too long")
+		}
+		req = append(req, AddrTypeDom, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(append(req, AddrTypeIPv4), ip4...)
+	} else {
+		req = append(append(req, AddrTypeIPv6), ip.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+
+	// Risposta: VER REP RSV ATYP BND.ADDR BND.PORT
+	var hdr [4]byte
+	if _, err := io.ReadFull(c, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[1] != socksRepSuccess {
+		return socksReplyError(hdr[1])
+	}
+	var skip int
+	switch hdr[3] {
+	case AddrTypeIPv4:
+		skip = 4
+	case AddrTypeIPv6:
+		skip = 16
+	case AddrTypeDom:
+		var l [1]byte
+		if _, err := io.ReadFull(c, l[:]); err != nil {
+			return err
+		}
+		skip = int(l[0])
+	default:
+		return fmt.Errorf("invalid address type %#x in reply", hdr[3])
+	}
+	_, err = io.CopyN(io.Discard, c, int64(skip+2))
+	return err
+}
+
+// socksReplyError traduce il codice di risposta SOCKS5 in un errore con l'errno
+// corrispondente, così le metriche lo classificano come un dial diretto
+func socksReplyError(rep byte) error {
+	errno := map[byte]syscall.Errno{
+		socksRepNotAllowed:      syscall.EACCES,
+		socksRepNetUnreachable:  syscall.ENETUNREACH,
+		socksRepHostUnreachable: syscall.EHOSTUNREACH,
+		socksRepConnRefused:     syscall.ECONNREFUSED,
+		socksRepTTLExpired:      syscall.ETIMEDOUT,
+	}[rep]
+	if errno == 0 {
+		return fmt.Errorf("proxy replied with error %#x", rep)
+	}
+	return fmt.Errorf("proxy replied with error %#x: %w", rep, errno)
+}
+
+// httpConnect apre il tunnel con il metodo CONNECT su un proxy HTTP
+func httpConnect(c net.Conn, u *url.URL, remoteAddr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: remoteAddr},
+		Host:   remoteAddr,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		cred := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+cred)
+	}
+	if err := req.Write(c); err != nil {
+		return c, err
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return c, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode == http.StatusProxyAuthRequired:
+		return c, errors.New("proxy authentication required")
+	case resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusServiceUnavailable:
+		return c, fmt.Errorf("proxy replied %s: %w", resp.Status, syscall.EHOSTUNREACH)
+	case resp.StatusCode == http.StatusGatewayTimeout:
+		return c, fmt.Errorf("proxy replied %s: %w", resp.Status, syscall.ETIMEDOUT)
+	default:
+		return c, fmt.Errorf("proxy replied %s", resp.Status)
+	}
+	if br.Buffered() > 0 {
+		// Dati del server arrivati insieme alla risposta: vanno letti prima del socket
+		return &bufferedConn{Conn: c, r: br}, nil
+	}
+	return c, nil
+}
+
+// bufferedConn legge prima i byte rimasti nel bufio.Reader della negoziazione
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
+
+// CloseWrite inoltra l'half-close alla connessione sottostante, se lo supporta
+func (b *bufferedConn) CloseWrite() error {
+	if hc, ok := b.Conn.(interface{ CloseWrite() error }); ok {
+		return hc.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// watchInterfaces non è disponibile fuori da Linux: resta il pulsante "Refresh Interfaces"
+func watchInterfaces(onChange func()) error {
+	return errors.New("interface hotplug detection is only supported on Linux")
+}